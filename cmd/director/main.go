@@ -4,17 +4,27 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/KalyanAkella/director/internal/proxy"
 	"gopkg.in/yaml.v2"
 )
 
 var (
-	configFile string
+	configFile    string
+	watchInterval time.Duration
 )
 
 func init() {
 	flag.StringVar(&configFile, "configFile", "", "Path to the Director YML config file")
+	flag.DurationVar(&watchInterval, "watchConfig", 0, "Interval at which the config file is checked for changes and reloaded (disabled when 0)")
+}
+
+type reloader interface {
+	Reload(*proxy.ProxyConfig) error
 }
 
 func parseConfig() (*proxy.ProxyConfig, error) {
@@ -30,7 +40,70 @@ func parseConfig() (*proxy.ProxyConfig, error) {
 	}
 }
 
+func configModTime() time.Time {
+	if info, err := os.Stat(configFile); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+func reloadConfig(director reloader) {
+	if dir_opts, err := parseConfig(); err != nil {
+		log.Printf("Unable to read config file %s. Keeping the current configuration. Error: %s", configFile, err.Error())
+	} else if err := director.Reload(dir_opts); err != nil {
+		log.Printf("Invalid config file %s. Keeping the current configuration. Error: %s", configFile, err.Error())
+	} else {
+		log.Printf("Reloaded config file %s", configFile)
+	}
+}
+
+// watchConfig reloads the config file on SIGHUP and, when enabled, whenever its modification time changes
+func watchConfig(director reloader) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	var ticks <-chan time.Time
+	modTime := configModTime()
+	if watchInterval > 0 {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		select {
+		case <-hangups:
+			modTime = configModTime()
+			reloadConfig(director)
+		case <-ticks:
+			if latest := configModTime(); !latest.Equal(modTime) {
+				modTime = latest
+				reloadConfig(director)
+			}
+		}
+	}
+}
+
+// replay runs the replay subcommand: director replay -configFile <file> -captureFile <file>
+func replay(args []string) {
+	var options proxy.ReplayOptions
+	replayFlags := flag.NewFlagSet("replay", flag.ExitOnError)
+	replayFlags.StringVar(&configFile, "configFile", "", "Path to the Director YML config file")
+	replayFlags.StringVar(&options.CaptureFile, "captureFile", "", "Path to the capture file to replay")
+	replayFlags.StringVar(&options.Mode, "mode", proxy.ReplayOriginalTiming, "Pacing of the replay: original, rps or fast")
+	replayFlags.Float64Var(&options.RPS, "rps", 0, "Requests per second when the pacing is rps")
+	replayFlags.IntVar(&options.Concurrency, "concurrency", 10, "Maximum number of requests replayed concurrently")
+	replayFlags.Parse(args)
+	if dir_opts, err := parseConfig(); err != nil {
+		log.Fatal(err)
+	} else if err := proxy.Replay(dir_opts, &options, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
 	flag.Parse()
 	if dir_opts, err := parseConfig(); err != nil {
 		log.Fatal(err)
@@ -38,7 +111,22 @@ func main() {
 		if director, err := proxy.NewDirector(dir_opts); err != nil {
 			log.Fatal(err)
 		} else {
-			log.Fatal(director.ListenAndServe())
+			go watchConfig(director)
+			serve_errors := make(chan error, 1)
+			go func() {
+				serve_errors <- director.ListenAndServe()
+			}()
+			stops := make(chan os.Signal, 1)
+			signal.Notify(stops, syscall.SIGTERM, os.Interrupt)
+			select {
+			case err := <-serve_errors:
+				log.Fatal(err)
+			case sig := <-stops:
+				log.Printf("Received %s. Shutting down", sig)
+				if err := director.Shutdown(); err != nil {
+					log.Fatal(err)
+				}
+			}
 		}
 	}
 }
@@ -3,6 +3,7 @@ module github.com/KalyanAkella/director
 go 1.13
 
 require (
+	github.com/prometheus/client_golang v1.7.0
 	gopkg.in/alexcesaro/statsd.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Labels attached to every Prometheus metric. Labels that are not given
+// for a particular metric are reported as empty.
+var PrometheusLabels = []string{"backend", "role", "method", "status", "status_class", "route"}
+
+var invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+type prometheusMetrics struct {
+	namespace  string
+	registry   *prometheus.Registry
+	lock       sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+type prometheusReporter struct {
+	metrics *prometheusMetrics
+	labels  prometheus.Labels
+}
+
+func NewPrometheusReporter(namespace string) *prometheusReporter {
+	return &prometheusReporter{
+		metrics: &prometheusMetrics{
+			namespace:  namespace,
+			registry:   prometheus.NewRegistry(),
+			counters:   make(map[string]*prometheus.CounterVec),
+			gauges:     make(map[string]*prometheus.GaugeVec),
+			histograms: make(map[string]*prometheus.HistogramVec),
+		},
+		labels: labelValues(nil),
+	}
+}
+
+// metricName turns a dotted tag such as primary.success.count into primary_success.
+// A leading namespace is dropped since it is already part of the full metric name.
+func (m *prometheusMetrics) metricName(tag string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(tag, m.namespace+"."), ".count")
+	return invalidMetricChars.ReplaceAllString(name, "_")
+}
+
+func labelValues(labels Labels) prometheus.Labels {
+	values := make(prometheus.Labels, len(PrometheusLabels))
+	for _, name := range PrometheusLabels {
+		values[name] = labels[name]
+	}
+	return values
+}
+
+func (m *prometheusMetrics) counter(tag string) *prometheus.CounterVec {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name := m.metricName(tag) + "_total"
+	if c, present := m.counters[name]; present {
+		return c
+	}
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: m.namespace, Name: name, Help: "Total " + tag}, PrometheusLabels)
+	m.registry.MustRegister(c)
+	m.counters[name] = c
+	return c
+}
+
+func (m *prometheusMetrics) gauge(tag string) *prometheus.GaugeVec {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name := m.metricName(tag)
+	if g, present := m.gauges[name]; present {
+		return g
+	}
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: m.namespace, Name: name, Help: "Current " + tag}, PrometheusLabels)
+	m.registry.MustRegister(g)
+	m.gauges[name] = g
+	return g
+}
+
+func (m *prometheusMetrics) histogram(tag string) *prometheus.HistogramVec {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name := m.metricName(tag) + "_seconds"
+	if h, present := m.histograms[name]; present {
+		return h
+	}
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: m.namespace, Name: name, Help: "Latency of " + tag, Buckets: prometheus.DefBuckets}, PrometheusLabels)
+	m.registry.MustRegister(h)
+	m.histograms[name] = h
+	return h
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	case time.Duration:
+		return v.Seconds()
+	default:
+		return 0
+	}
+}
+
+// Handler serves the collected metrics in the Prometheus exposition format
+func (r *prometheusReporter) Handler() http.Handler {
+	return promhttp.HandlerFor(r.metrics.registry, promhttp.HandlerOpts{})
+}
+
+func (r *prometheusReporter) With(labels Labels) Reporter {
+	merged := make(Labels, len(r.labels)+len(labels))
+	for k, v := range r.labels {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return &prometheusReporter{metrics: r.metrics, labels: labelValues(merged)}
+}
+
+func (r *prometheusReporter) Increment(tag string) {
+	r.metrics.counter(tag).With(r.labels).Inc()
+}
+
+func (r *prometheusReporter) Gauge(tag string, value interface{}) {
+	r.metrics.gauge(tag).With(r.labels).Set(toFloat(value))
+}
+
+func (r *prometheusReporter) Count(tag string, value interface{}) {
+	if v := toFloat(value); v >= 0 {
+		r.metrics.counter(tag).With(r.labels).Add(v)
+	}
+}
+
+func (r *prometheusReporter) StartTiming() *TimingContext {
+	return &TimingContext{Context: time.Now()}
+}
+
+func (r *prometheusReporter) EndTiming(tc *TimingContext, tag string) {
+	if tc != nil && tc.Context != nil {
+		r.metrics.histogram(tag).With(r.labels).Observe(time.Since(tc.Context.(time.Time)).Seconds())
+	}
+}
+
+func (r *prometheusReporter) Close() {}
@@ -1,6 +1,11 @@
 package metrics
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"gopkg.in/alexcesaro/statsd.v2"
 )
 
@@ -8,43 +13,105 @@ type TimingContext struct {
 	Context interface{}
 }
 
+// Labels qualify a metric, e.g. by backend and role. Reporters that
+// do not support labels ignore them.
+type Labels map[string]string
+
 type Reporter interface {
+	With(labels Labels) Reporter
 	Increment(tag string)
 	Gauge(tag string, value interface{})
 	Count(tag string, value interface{})
 	StartTiming() *TimingContext
 	EndTiming(tc *TimingContext, tag string)
+	Close()
 }
 
 type noopReporter struct{}
 
+func (r *noopReporter) With(labels Labels) Reporter             { return r }
 func (r *noopReporter) StartTiming() *TimingContext             { return nil }
 func (r *noopReporter) Increment(tag string)                    {}
 func (r *noopReporter) Gauge(tag string, value interface{})     {}
 func (r *noopReporter) Count(tag string, value interface{})     {}
 func (r *noopReporter) Time(tag string)                         {}
 func (r *noopReporter) EndTiming(tc *TimingContext, tag string) {}
+func (r *noopReporter) Close()                                  {}
 
 func NewNoopReporter() *noopReporter {
 	return &noopReporter{}
 }
 
+// Supported formats for StatsD tags. Without a tag format the backend
+// label is made part of the metric name instead.
+const (
+	StatsDTagFormatDatadog  = "datadog"
+	StatsDTagFormatInfluxDB = "influxdb"
+)
+
+var invalidBucketChars = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", ",", "_", "#", "_")
+
 type statsDReporter struct {
 	client     *statsd.Client
 	errHandler StatsDErrorHandler
+	tagged     bool
+	backend    string
 }
 
 type StatsDErrorHandler func(string)
 
-func NewStatsDReporter(metricPrefix, statsdAddr string, errorHandler StatsDErrorHandler) (*statsDReporter, error) {
+func NewStatsDReporter(metricPrefix, statsdAddr, tagFormat string, errorHandler StatsDErrorHandler) (*statsDReporter, error) {
 	opts := []statsd.Option{statsd.Prefix(metricPrefix), statsd.Address(statsdAddr)}
+	switch tagFormat {
+	case "":
+	case StatsDTagFormatDatadog:
+		opts = append(opts, statsd.TagsFormat(statsd.Datadog))
+	case StatsDTagFormatInfluxDB:
+		opts = append(opts, statsd.TagsFormat(statsd.InfluxDB))
+	default:
+		return nil, fmt.Errorf("unknown tag format %s", tagFormat)
+	}
 	if client, err := statsd.New(opts...); err == nil && client != nil {
-		return &statsDReporter{client, errorHandler}, nil
+		return &statsDReporter{client: client, errHandler: errorHandler, tagged: tagFormat != ""}, nil
 	} else {
 		return nil, err
 	}
 }
 
+// With either attaches the labels as StatsD tags or, without a tag
+// format, reports metrics both under their aggregate name and under a
+// per-backend name such as secondary.<backend>.success.count.
+func (r *statsDReporter) With(labels Labels) Reporter {
+	if !r.tagged {
+		if backend := labels["backend"]; backend != "" {
+			return &statsDReporter{client: r.client, errHandler: r.errHandler, backend: invalidBucketChars.Replace(backend)}
+		}
+		return r
+	}
+	names := make([]string, 0, len(labels))
+	for name, value := range labels {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	tags := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		tags = append(tags, name, labels[name])
+	}
+	return &statsDReporter{client: r.client.Clone(statsd.Tags(tags...)), errHandler: r.errHandler, tagged: true}
+}
+
+func (r *statsDReporter) buckets(tag string) []string {
+	if r.backend == "" {
+		return []string{tag}
+	}
+	if parts := strings.SplitN(tag, ".", 2); len(parts) == 2 {
+		return []string{tag, parts[0] + "." + r.backend + "." + parts[1]}
+	}
+	return []string{tag, tag + "." + r.backend}
+}
+
 func (r *statsDReporter) Close() {
 	defer r.errHandler("Close")
 	r.client.Close()
@@ -52,17 +119,23 @@ func (r *statsDReporter) Close() {
 
 func (r *statsDReporter) Increment(tag string) {
 	defer r.errHandler("Increment")
-	r.client.Increment(tag)
+	for _, bucket := range r.buckets(tag) {
+		r.client.Increment(bucket)
+	}
 }
 
 func (r *statsDReporter) Gauge(tag string, value interface{}) {
 	defer r.errHandler("Gauge")
-	r.client.Gauge(tag, value)
+	for _, bucket := range r.buckets(tag) {
+		r.client.Gauge(bucket, value)
+	}
 }
 
 func (r *statsDReporter) Count(tag string, value interface{}) {
 	defer r.errHandler("Count")
-	r.client.Count(tag, value)
+	for _, bucket := range r.buckets(tag) {
+		r.client.Count(bucket, value)
+	}
 }
 
 func (r *statsDReporter) StartTiming() *TimingContext {
@@ -73,6 +146,65 @@ func (r *statsDReporter) StartTiming() *TimingContext {
 func (r *statsDReporter) EndTiming(tc *TimingContext, tag string) {
 	defer r.errHandler("EndTiming")
 	if tc.Context != nil {
-		tc.Context.(statsd.Timing).Send(tag)
+		elapsed := int(tc.Context.(statsd.Timing).Duration() / time.Millisecond)
+		for _, bucket := range r.buckets(tag) {
+			r.client.Timing(bucket, elapsed)
+		}
+	}
+}
+
+type multiReporter struct {
+	reporters []Reporter
+}
+
+// NewMultiReporter reports every metric to all the given reporters
+func NewMultiReporter(reporters ...Reporter) *multiReporter {
+	return &multiReporter{reporters}
+}
+
+func (r *multiReporter) With(labels Labels) Reporter {
+	labelled := make([]Reporter, len(r.reporters))
+	for i, reporter := range r.reporters {
+		labelled[i] = reporter.With(labels)
+	}
+	return &multiReporter{labelled}
+}
+
+func (r *multiReporter) Increment(tag string) {
+	for _, reporter := range r.reporters {
+		reporter.Increment(tag)
+	}
+}
+
+func (r *multiReporter) Gauge(tag string, value interface{}) {
+	for _, reporter := range r.reporters {
+		reporter.Gauge(tag, value)
+	}
+}
+
+func (r *multiReporter) Count(tag string, value interface{}) {
+	for _, reporter := range r.reporters {
+		reporter.Count(tag, value)
+	}
+}
+
+func (r *multiReporter) StartTiming() *TimingContext {
+	contexts := make([]*TimingContext, len(r.reporters))
+	for i, reporter := range r.reporters {
+		contexts[i] = reporter.StartTiming()
+	}
+	return &TimingContext{Context: contexts}
+}
+
+func (r *multiReporter) EndTiming(tc *TimingContext, tag string) {
+	contexts := tc.Context.([]*TimingContext)
+	for i, reporter := range r.reporters {
+		reporter.EndTiming(contexts[i], tag)
+	}
+}
+
+func (r *multiReporter) Close() {
+	for _, reporter := range r.reporters {
+		reporter.Close()
 	}
 }
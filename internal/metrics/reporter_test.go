@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatsDPerBackendBuckets(t *testing.T) {
+	r := &statsDReporter{}
+	labelled := r.With(Labels{"backend": "B.1", "role": "secondary"}).(*statsDReporter)
+	buckets := labelled.buckets("secondary.success.count")
+	if len(buckets) != 2 || buckets[0] != "secondary.success.count" || buckets[1] != "secondary.B_1.success.count" {
+		t.Errorf("Unexpected buckets: %v", buckets)
+	}
+	if buckets := r.With(Labels{"method": "GET"}).(*statsDReporter).buckets("director.request.count"); len(buckets) != 1 {
+		t.Errorf("Expected only the aggregate bucket without a backend label. Actual: %v", buckets)
+	}
+}
+
+func TestPrometheusLabelledCounters(t *testing.T) {
+	r := NewPrometheusReporter("director")
+	r.With(Labels{"backend": "B1", "role": "secondary"}).Increment("secondary.match.count")
+	r.With(Labels{"method": "GET"}).Increment("director.request.count")
+	rw := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	body := rw.Body.String()
+	for _, expected := range []string{
+		`director_secondary_match_total{backend="B1",method="",role="secondary",route="",status="",status_class=""} 1`,
+		`director_request_total{backend="",method="GET",role="",route="",status="",status_class=""} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metric %s in:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KalyanAkella/director/internal/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+// Number of most recent mismatches kept for the admin API
+const RecentMismatchesSize = 100
+
+// Placeholder for the header values and URL passwords left out of /config
+const RedactedValue = "REDACTED"
+
+// Health of a backend as seen by its health checks, or from the outcome
+// of the last request sent to it when it has none
+const (
+	HealthUnknown = "unknown"
+	HealthUp      = "up"
+	HealthDown    = "down"
+)
+
+type BackendStatus struct {
+	ID          string            `json:"id"`
+	Role        string            `json:"role"`
+	URL         string            `json:"url"`
+	Health      string            `json:"health"`
+	Paused      bool              `json:"paused,omitempty"`
+	SampleRate  float64           `json:"sampleRate,omitempty"`
+	QueueLength int               `json:"queueLength,omitempty"`
+	Circuit     string            `json:"circuit,omitempty"`
+	Counters    map[string]uint64 `json:"counters"`
+}
+
+type HealthStatus struct {
+	Status   string            `json:"status"`
+	Backends map[string]string `json:"backends"`
+}
+
+type Mismatch struct {
+	Timestamp time.Time `json:"timestamp"`
+	Backend   string    `json:"backend"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Diffs     []string  `json:"diffs"`
+}
+
+// backendCounters keeps in-process counters of every metric reported
+// with a backend label. They are kept across configuration reloads.
+type backendCounters struct {
+	lock   sync.Mutex
+	counts map[string]map[string]uint64
+	health map[string]string
+}
+
+// countingReporter feeds the metrics reported for a backend into backendCounters
+type countingReporter struct {
+	counters *backendCounters
+	backend  string
+}
+
+// mismatchLog is a ring buffer of the most recent mismatches
+type mismatchLog struct {
+	lock    sync.Mutex
+	entries []Mismatch
+	next    int
+	size    int
+}
+
+func newBackendCounters() *backendCounters {
+	return &backendCounters{counts: make(map[string]map[string]uint64), health: make(map[string]string)}
+}
+
+func (c *backendCounters) add(backend, tag string, value uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts, present := c.counts[backend]
+	if !present {
+		counts = make(map[string]uint64)
+		c.counts[backend] = counts
+	}
+	counts[tag] += value
+	switch {
+	case strings.HasSuffix(tag, ".success.count"):
+		c.health[backend] = HealthUp
+	case strings.HasSuffix(tag, ".failure.count"), strings.HasSuffix(tag, ".timeout.count"):
+		c.health[backend] = HealthDown
+	}
+}
+
+func (c *backendCounters) snapshot(backend string) (map[string]uint64, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := make(map[string]uint64, len(c.counts[backend]))
+	for tag, value := range c.counts[backend] {
+		counts[tag] = value
+	}
+	if health, present := c.health[backend]; present {
+		return counts, health
+	}
+	return counts, HealthUnknown
+}
+
+func (r *countingReporter) With(labels metrics.Labels) metrics.Reporter {
+	if backend := labels["backend"]; backend != "" {
+		return &countingReporter{counters: r.counters, backend: backend}
+	}
+	return r
+}
+
+func (r *countingReporter) Increment(tag string) {
+	if r.backend != "" {
+		r.counters.add(r.backend, tag, 1)
+	}
+}
+
+func (r *countingReporter) Count(tag string, value interface{}) {
+	if n, ok := value.(int); r.backend != "" && ok && n >= 0 {
+		r.counters.add(r.backend, tag, uint64(n))
+	}
+}
+
+func (r *countingReporter) Gauge(tag string, value interface{}) {}
+
+func (r *countingReporter) StartTiming() *metrics.TimingContext { return nil }
+
+func (r *countingReporter) EndTiming(tc *metrics.TimingContext, tag string) {}
+
+func (r *countingReporter) Close() {}
+
+func newMismatchLog(size int) *mismatchLog {
+	return &mismatchLog{size: size}
+}
+
+func (l *mismatchLog) add(req *http.Request, be *backend, diffs []string) {
+	entry := Mismatch{Timestamp: time.Now(), Backend: be.id, Method: req.Method, URL: req.URL.RequestURI(), Diffs: diffs}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.entries) < l.size {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.next] = entry
+		l.next = (l.next + 1) % l.size
+	}
+}
+
+// recent returns the kept mismatches, most recent first
+func (l *mismatchLog) recent() []Mismatch {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	recent := make([]Mismatch, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		recent = append(recent, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return recent
+}
+
+// newAdminServer serves runtime information about the director on a
+// listener separate from the proxied traffic. Changes made through it
+// only last until the next configuration reload.
+func newAdminServer(addr string, b *director) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latency", b.latencyHandler)
+	mux.HandleFunc("/config", b.configHandler)
+	mux.HandleFunc("/backends", b.backendsHandler)
+	mux.HandleFunc("/backends/", b.backendControlHandler)
+	mux.HandleFunc("/mismatches", b.mismatchesHandler)
+	mux.HandleFunc("/health", b.healthHandler)
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func writeJSON(rw http.ResponseWriter, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(rw)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		errorLog("Unable to encode admin response. Error: " + err.Error())
+	}
+}
+
+func (b *director) latencyHandler(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, b.latencies.summaries())
+}
+
+// redactedConfig returns a copy of the configuration without the header
+// values and the passwords in the URLs and proxy URLs of the backends,
+// which usually carry the credentials of test backends.
+func redactedConfig(config *ProxyConfig) *ProxyConfig {
+	redacted := *config
+	redacted.Backends = make(map[string]*BackendConfig, len(config.Backends))
+	for id, v := range config.Backends {
+		if v == nil {
+			redacted.Backends[id] = nil
+			continue
+		}
+		be := *v
+		be.URL = redactURL(v.URL)
+		be.Headers = redactValues(v.Headers)
+		if v.HeaderRules != nil {
+			rules := *v.HeaderRules
+			rules.Add, rules.Set = redactValues(rules.Add), redactValues(rules.Set)
+			be.HeaderRules = &rules
+		}
+		if v.Transport != nil {
+			transport := *v.Transport
+			transport.Proxy = redactURL(transport.Proxy)
+			be.Transport = &transport
+		}
+		redacted.Backends[id] = &be
+	}
+	return &redacted
+}
+
+func redactValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(values))
+	for k := range values {
+		redacted[k] = RedactedValue
+	}
+	return redacted
+}
+
+func redactURL(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.User != nil {
+		if _, present := u.User.Password(); present {
+			u.User = url.UserPassword(u.User.Username(), RedactedValue)
+			return u.String()
+		}
+	}
+	return addr
+}
+
+// configHandler writes the configuration currently in effect in the format
+// of the config file, with credentials redacted
+func (b *director) configHandler(rw http.ResponseWriter, req *http.Request) {
+	if out, err := yaml.Marshal(redactedConfig(b.currentState().config)); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	} else {
+		rw.Header().Set("Content-Type", "application/x-yaml")
+		rw.Write(out)
+	}
+}
+
+func (b *director) backendsHandler(rw http.ResponseWriter, req *http.Request) {
+	state := b.currentState()
+	var statuses []BackendStatus
+	listed := make(map[string]bool)
+	for _, r := range state.routes {
+		if !listed[r.primary.id] {
+			listed[r.primary.id] = true
+			statuses = append(statuses, b.backendStatus(r.primary, "primary"))
+		}
+		for _, fallback := range r.fallbacks {
+			if !listed[fallback.id] {
+				listed[fallback.id] = true
+				statuses = append(statuses, b.backendStatus(fallback, "fallback"))
+			}
+		}
+	}
+	secondaries := make([]string, 0, len(state.mirrors))
+	for id := range state.mirrors {
+		secondaries = append(secondaries, id)
+	}
+	sort.Strings(secondaries)
+	for _, id := range secondaries {
+		statuses = append(statuses, b.mirrorStatus(state.mirrors[id]))
+	}
+	writeJSON(rw, statuses)
+}
+
+func (b *director) backendStatus(be *backend, role string) BackendStatus {
+	counters, health := b.counters.snapshot(be.id)
+	if be.health != nil {
+		health = HealthDown
+		if be.health.isHealthy() {
+			health = HealthUp
+		}
+	}
+	return BackendStatus{ID: be.id, Role: role, URL: be.addr.String(), Health: health, Counters: counters}
+}
+
+func (b *director) mirrorStatus(m *mirror) BackendStatus {
+	status := b.backendStatus(m.be, "secondary")
+	status.Paused, status.SampleRate, status.QueueLength = m.isPaused(), m.sampleRate(), len(m.queue)
+	status.Circuit = m.be.breaker.currentState()
+	return status
+}
+
+// healthHandler answers with 503 Service Unavailable when a route has no
+// healthy primary or fallback left, along with the health of every backend.
+func (b *director) healthHandler(rw http.ResponseWriter, req *http.Request) {
+	state := b.currentState()
+	status := HealthStatus{Status: HealthUp, Backends: make(map[string]string, len(state.config.backends))}
+	for id, be := range state.config.backends {
+		if be.health == nil {
+			status.Backends[id] = HealthUnknown
+		} else if be.health.isHealthy() {
+			status.Backends[id] = HealthUp
+		} else {
+			status.Backends[id] = HealthDown
+		}
+	}
+	for _, r := range state.routes {
+		if !healthyFirst(append([]*backend{r.primary}, r.fallbacks...))[0].health.isHealthy() {
+			status.Status = HealthDown
+		}
+	}
+	if status.Status == HealthDown {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(rw, status)
+}
+
+func (b *director) mismatchesHandler(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, b.mismatches.recent())
+}
+
+// backendControlHandler serves POST /backends/<id>/pause, /backends/<id>/resume
+// and /backends/<id>/sample-rate?rate=<percentage> for secondary backends.
+func (b *director) backendControlHandler(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/backends/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(rw, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m, present := b.currentState().mirrors[parts[0]]
+	if !present {
+		http.Error(rw, fmt.Sprintf("No secondary backend with ID: %s", parts[0]), http.StatusNotFound)
+		return
+	}
+	switch parts[1] {
+	case "pause":
+		m.setPaused(true)
+		infoLog(fmt.Sprintf("Paused mirroring to secondary endpoint [%s]", m.be.id))
+	case "resume":
+		m.setPaused(false)
+		infoLog(fmt.Sprintf("Resumed mirroring to secondary endpoint [%s]", m.be.id))
+	case "sample-rate":
+		rate, err := strconv.ParseFloat(req.FormValue("rate"), 64)
+		if err != nil || rate < 0 || rate > FullSampleRate {
+			http.Error(rw, "Sample rate must be a number between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		m.setSampleRate(rate)
+		infoLog(fmt.Sprintf("Changed sample rate of secondary endpoint [%s] to %v", m.be.id, rate))
+	default:
+		http.NotFound(rw, req)
+		return
+	}
+	writeJSON(rw, b.mirrorStatus(m))
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Host header policies for requests sent to a backend
+const (
+	HostBackend = "backend"
+	HostClient  = "client"
+	HostFixed   = "fixed"
+)
+
+// BackendConfig describes a single backend. It can be given either as a
+// plain URL string or as an object with the fields below.
+type BackendConfig struct {
+	URL             string                 `yaml:"URL"`
+	Timeout         time.Duration          `yaml:"Timeout"`
+	ConnectTimeout  time.Duration          `yaml:"ConnectTimeout"`
+	ResponseTimeout time.Duration          `yaml:"ResponseTimeout"`
+	SampleRate      *float64               `yaml:"SampleRate"`
+	Headers         map[string]string      `yaml:"Headers"`
+	TLS             *TLSOptions            `yaml:"TLS"`
+	Enabled         *bool                  `yaml:"Enabled"`
+	QueueSize       int                    `yaml:"QueueSize"`
+	Workers         int                    `yaml:"Workers"`
+	DropPolicy      string                 `yaml:"DropPolicy"`
+	Filter          *FilterOptions         `yaml:"Filter"`
+	HeaderRules     *HeaderRules           `yaml:"HeaderRules"`
+	HostPolicy      string                 `yaml:"HostPolicy"`
+	Host            string                 `yaml:"Host"`
+	CircuitBreaker  *CircuitBreakerOptions `yaml:"CircuitBreaker"`
+	HealthCheck     *HealthCheckOptions    `yaml:"HealthCheck"`
+	Transport       *TransportOptions      `yaml:"Transport"`
+}
+
+type TLSOptions struct {
+	CAFile             string `yaml:"CAFile"`
+	CertFile           string `yaml:"CertFile"`
+	KeyFile            string `yaml:"KeyFile"`
+	ServerName         string `yaml:"ServerName"`
+	InsecureSkipVerify bool   `yaml:"InsecureSkipVerify"`
+}
+
+// Proxy setting that connects to a backend without any HTTP proxy
+const ProxyDirect = "direct"
+
+// TransportOptions tune the connection pool of a backend. Zero values keep
+// the defaults of the Go HTTP client, except for MaxIdleConnsPerHost which
+// defaults to 100. Proxy is the URL of an HTTP proxy, or direct to bypass
+// the proxy configured through the environment.
+type TransportOptions struct {
+	MaxIdleConns        int           `yaml:"MaxIdleConns"`
+	MaxIdleConnsPerHost int           `yaml:"MaxIdleConnsPerHost"`
+	MaxConnsPerHost     int           `yaml:"MaxConnsPerHost"`
+	IdleConnTimeout     time.Duration `yaml:"IdleConnTimeout"`
+	KeepAlive           time.Duration `yaml:"KeepAlive"`
+	DisableKeepAlives   bool          `yaml:"DisableKeepAlives"`
+	HTTP2               *bool         `yaml:"HTTP2"`
+	Proxy               string        `yaml:"Proxy"`
+}
+
+type backend struct {
+	id         string
+	addr       *url.URL
+	sampleRate float64
+	timeout    time.Duration
+	headers    map[string]string
+	transport  *http.Transport
+	queueSize  int
+	workers    int
+	dropPolicy string
+	filter     *requestFilter
+	shadow     bool
+	rules      *HeaderRules
+	hostPolicy string
+	fixedHost  string
+	breaker    *circuitBreaker
+	health     *healthCheck
+}
+
+func (c *BackendConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addr string
+	if err := unmarshal(&addr); err == nil {
+		c.URL = addr
+		return nil
+	}
+	type plain BackendConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *BackendConfig) isEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func newBackend(id string, config *BackendConfig, rate float64) (*backend, error) {
+	if config == nil || config.URL == "" {
+		return nil, proxyError(fmt.Sprintf("Backend endpoint with ID: %s does not have any associated data", id))
+	}
+	backend_url, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, proxyError(fmt.Sprintf("Invalid url: %s for endpoint with ID: %s. Error: %s", config.URL, id, err.Error()))
+	}
+	if config.Timeout < 0 || config.ConnectTimeout < 0 || config.ResponseTimeout < 0 {
+		return nil, proxyError(fmt.Sprintf("Timeouts for endpoint with ID: %s cannot be negative", id))
+	}
+	if config.QueueSize < 0 || config.Workers < 0 {
+		return nil, proxyError(fmt.Sprintf("Queue size and workers for endpoint with ID: %s cannot be negative", id))
+	}
+	if err := validateDropPolicy(id, config.DropPolicy); err != nil {
+		return nil, err
+	}
+	switch config.HostPolicy {
+	case "", HostBackend, HostClient:
+		if config.Host != "" {
+			return nil, proxyError(fmt.Sprintf("Host for endpoint with ID: %s requires the %s host policy", id, HostFixed))
+		}
+	case HostFixed:
+		if config.Host == "" {
+			return nil, proxyError(fmt.Sprintf("Host is missing for endpoint with ID: %s", id))
+		}
+	default:
+		return nil, proxyError(fmt.Sprintf("Invalid host policy: %s for endpoint with ID: %s. Must be one of %s, %s or %s", config.HostPolicy, id, HostBackend, HostClient, HostFixed))
+	}
+	be := &backend{
+		id:         id,
+		addr:       backend_url,
+		sampleRate: rate,
+		timeout:    config.Timeout,
+		headers:    config.Headers,
+		rules:      config.HeaderRules,
+		hostPolicy: config.HostPolicy,
+		fixedHost:  config.Host,
+		queueSize:  config.QueueSize,
+		workers:    config.Workers,
+		dropPolicy: config.DropPolicy,
+	}
+	if be.filter, err = newRequestFilter(id, config.Filter); err != nil {
+		return nil, err
+	}
+	if be.breaker, err = newCircuitBreaker(id, config.CircuitBreaker); err != nil {
+		return nil, err
+	}
+	if be.health, err = newHealthCheck(id, config.HealthCheck); err != nil {
+		return nil, err
+	}
+	if be.queueSize == 0 {
+		be.queueSize = DefaultQueueSize
+	}
+	if be.workers == 0 {
+		be.workers = DefaultWorkers
+	}
+	if config.TLS != nil && backend_url.Scheme != "https" {
+		return nil, proxyError(fmt.Sprintf("TLS settings for endpoint with ID: %s require an https URL", id))
+	}
+	if transport, err := newTransport(config); err != nil {
+		return nil, proxyError(fmt.Sprintf("Invalid transport settings for endpoint with ID: %s. Error: %s", id, err.Error()))
+	} else {
+		be.transport = transport
+	}
+	return be, nil
+}
+
+// newTransport returns the transport dedicated to a backend, so that its
+// connection pool and TLS settings are not shared with other backends.
+func newTransport(config *BackendConfig) (*http.Transport, error) {
+	options := config.Transport
+	if options == nil {
+		options = &TransportOptions{}
+	}
+	if options.MaxIdleConns < 0 || options.MaxIdleConnsPerHost < 0 || options.MaxConnsPerHost < 0 || options.IdleConnTimeout < 0 {
+		return nil, fmt.Errorf("connection limits and timeouts cannot be negative")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if config.ConnectTimeout > 0 {
+		dialer.Timeout = config.ConnectTimeout
+	}
+	if options.KeepAlive != 0 {
+		dialer.KeepAlive = options.KeepAlive
+	}
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = config.ResponseTimeout
+	transport.MaxIdleConnsPerHost = MaxIdleConnsPerHost
+	if options.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+	if options.MaxIdleConns > 0 {
+		transport.MaxIdleConns = options.MaxIdleConns
+	}
+	if options.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = options.IdleConnTimeout
+	}
+	transport.MaxConnsPerHost = options.MaxConnsPerHost
+	transport.DisableKeepAlives = options.DisableKeepAlives
+	if options.HTTP2 != nil && !*options.HTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	switch options.Proxy {
+	case "":
+	case ProxyDirect:
+		transport.Proxy = nil
+	default:
+		if proxy_url, err := url.Parse(options.Proxy); err != nil || proxy_url.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL: %s", options.Proxy)
+		} else {
+			transport.Proxy = http.ProxyURL(proxy_url)
+		}
+	}
+	if config.TLS != nil {
+		if tlsConfig, err := newTLSConfig(config.TLS); err != nil {
+			return nil, err
+		} else {
+			transport.TLSClientConfig = tlsConfig
+		}
+	}
+	return transport, nil
+}
+
+func newTLSConfig(options *TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if options.CAFile != "" {
+		if pem, err := ioutil.ReadFile(options.CAFile); err != nil {
+			return nil, err
+		} else {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", options.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key files must be given together")
+	}
+	if options.CertFile != "" {
+		if cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile); err != nil {
+			return nil, err
+		} else {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	return tlsConfig, nil
+}
+
+// host returns the Host header for a request to the backend. An empty
+// host makes the transport use the host of the backend URL.
+func (be *backend) host(req *http.Request) string {
+	switch be.hostPolicy {
+	case HostClient:
+		return req.Host
+	case HostFixed:
+		return be.fixedHost
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const backendsYAML = `
+Options:
+  Port: 30303
+  PrimaryEndpoint: "1"
+Backends:
+  "1": http://127.0.0.1:50505
+  "2":
+    URL: http://127.0.0.1:51515
+    Timeout: 2s
+    SampleRate: 25
+    Headers:
+      X-Director-Shadow: "true"
+  "3":
+    URL: http://127.0.0.1:52525
+    Enabled: false
+`
+
+func TestBackendConfigAcceptsStringAndObjectForms(t *testing.T) {
+	var config ProxyConfig
+	if err := yaml.Unmarshal([]byte(backendsYAML), &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(&config); err != nil {
+		t.Fatal(err)
+	}
+	primary, secondaries := config.routes[0].primary, config.routes[0].secondaries
+	if primary.id != "1" || primary.addr.String() != "http://127.0.0.1:50505" {
+		t.Errorf("Unexpected primary backend [%s]:[%s]", primary.id, primary.addr)
+	}
+	if len(secondaries) != 1 {
+		t.Fatalf("Expected only the enabled secondary. Actual: %d secondaries", len(secondaries))
+	}
+	secondary := secondaries[0]
+	if secondary.id != "2" || secondary.timeout != 2*time.Second || secondary.sampleRate != 25 {
+		t.Errorf("Unexpected secondary backend %+v", secondary)
+	}
+	if secondary.headers["X-Director-Shadow"] != "true" {
+		t.Errorf("Expected extra headers on secondary. Actual: %v", secondary.headers)
+	}
+}
+
+func TestPrimaryBackendCannotBeDisabled(t *testing.T) {
+	disabled := false
+	config := &ProxyConfig{
+		Options:  &ProxyOptions{Port: 1, PrimaryEndpoint: "B1"},
+		Backends: map[string]*BackendConfig{"B1": {URL: "http://localhost:1", Enabled: &disabled}},
+	}
+	if err := validate(config); err == nil {
+		t.Error("Expected an error for a disabled primary backend")
+	}
+}
+
+func TestHostPolicy(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://shop.example.com/items", nil)
+	for policy, expected := range map[string]string{"": "127.0.0.1:51515", HostBackend: "127.0.0.1:51515", HostClient: "shop.example.com", HostFixed: "internal.example.com"} {
+		config := &BackendConfig{URL: "http://127.0.0.1:51515", HostPolicy: policy}
+		if policy == HostFixed {
+			config.Host = "internal.example.com"
+		}
+		be, err := newBackend("B1", config, FullSampleRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := newRequest(context.Background(), req, nil, be)
+		if out.Host == "" {
+			out.Host = out.URL.Host
+		}
+		if out.Host != expected {
+			t.Errorf("Expected host %s for policy %q. Actual: %s", expected, policy, out.Host)
+		}
+	}
+	for _, config := range []*BackendConfig{
+		{URL: "http://127.0.0.1:51515", HostPolicy: HostFixed},
+		{URL: "http://127.0.0.1:51515", Host: "internal.example.com"},
+		{URL: "http://127.0.0.1:51515", HostPolicy: "unknown"},
+	} {
+		if _, err := newBackend("B1", config, FullSampleRate); err == nil {
+			t.Errorf("Expected invalid host settings to be rejected %+v", config)
+		}
+	}
+}
+
+func TestMutualTLSBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := writeCertificate(t, dir, "backend")
+	clientCert, clientKey := writeCertificate(t, dir, "client")
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	if pem, err := ioutil.ReadFile(clientCert); err != nil {
+		t.Fatal(err)
+	} else {
+		clientCAs.AppendCertsFromPEM(pem)
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	be, err := newBackend("B1", &BackendConfig{URL: server.URL, TLS: &TLSOptions{CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey}}, FullSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	res, err := requestToBackend(newRequest(context.Background(), req, nil, be), be, &Reporter{metrics: make(map[string]uint64)}, "secondary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "client" {
+		t.Errorf("Expected the backend to see the client certificate. Actual: %s", body)
+	}
+
+	for _, options := range []*TLSOptions{{CertFile: clientCert}, {CAFile: filepath.Join(dir, "missing.pem")}} {
+		if _, err := newBackend("B1", &BackendConfig{URL: server.URL, TLS: options}, FullSampleRate); err == nil {
+			t.Errorf("Expected invalid TLS settings to be rejected %+v", options)
+		}
+	}
+	if _, err := newBackend("B1", &BackendConfig{URL: "http://localhost:1", TLS: &TLSOptions{}}, FullSampleRate); err == nil {
+		t.Error("Expected TLS settings to be rejected for an http URL")
+	}
+}
+
+func TestBackendTransport(t *testing.T) {
+	http2 := false
+	be, err := newBackend("B1", &BackendConfig{URL: "https://localhost:1", ConnectTimeout: time.Second, Transport: &TransportOptions{
+		MaxIdleConns: 10, MaxIdleConnsPerHost: 5, MaxConnsPerHost: 20, IdleConnTimeout: time.Minute, HTTP2: &http2, Proxy: "http://proxy:3128"}}, FullSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := be.transport
+	if transport == http.DefaultTransport {
+		t.Error("Expected a dedicated transport for the backend")
+	}
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 5 || transport.MaxConnsPerHost != 20 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Expected the connection pool settings to be applied. Actual: %+v", transport)
+	}
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+		t.Error("Expected HTTP/2 to be disabled")
+	}
+	req := httptest.NewRequest("GET", "https://localhost:1/", nil)
+	if proxy_url, _ := transport.Proxy(req); proxy_url == nil || proxy_url.Host != "proxy:3128" {
+		t.Errorf("Expected requests to go through the proxy. Actual: %v", proxy_url)
+	}
+
+	if be, err = newBackend("B1", &BackendConfig{URL: "http://localhost:1", Transport: &TransportOptions{Proxy: ProxyDirect}}, FullSampleRate); err != nil {
+		t.Fatal(err)
+	} else if transport := be.transport; transport.Proxy != nil || transport.MaxIdleConnsPerHost != MaxIdleConnsPerHost {
+		t.Errorf("Expected a direct connection with the default pool size. Actual: %+v", transport)
+	}
+
+	for _, options := range []*TransportOptions{{MaxIdleConns: -1}, {IdleConnTimeout: -time.Second}, {Proxy: "proxy:3128"}} {
+		if _, err := newBackend("B1", &BackendConfig{URL: "http://localhost:1", Transport: options}, FullSampleRate); err == nil {
+			t.Errorf("Expected invalid transport settings to be rejected %+v", options)
+		}
+	}
+}
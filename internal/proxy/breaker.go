@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults for the circuit breaker of a secondary backend
+const (
+	DefaultBreakerWindow       = 100
+	DefaultBreakerOpenDuration = 30 * time.Second
+	DefaultHalfOpenProbes      = 1
+)
+
+// States of a circuit breaker
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// CircuitBreakerOptions stop mirroring to a secondary that keeps failing.
+// The circuit opens after ConsecutiveFailures failed requests in a row, or
+// once ErrorRate percent of the last Window requests failed. After
+// OpenDuration, HalfOpenProbes requests are let through and the circuit
+// closes again if all of them succeed.
+type CircuitBreakerOptions struct {
+	ConsecutiveFailures int           `yaml:"ConsecutiveFailures"`
+	ErrorRate           float64       `yaml:"ErrorRate"`
+	Window              int           `yaml:"Window"`
+	OpenDuration        time.Duration `yaml:"OpenDuration"`
+	HalfOpenProbes      int           `yaml:"HalfOpenProbes"`
+}
+
+type circuitBreaker struct {
+	lock                sync.Mutex
+	consecutiveFailures int
+	errorRate           float64
+	openDuration        time.Duration
+	halfOpenProbes      int
+	state               string
+	failures            int
+	outcomes            []bool
+	next                int
+	openedAt            time.Time
+	probes              int
+	probeSuccesses      int
+	now                 func() time.Time
+}
+
+// newCircuitBreaker returns nil when no circuit breaker is configured
+func newCircuitBreaker(id string, options *CircuitBreakerOptions) (*circuitBreaker, error) {
+	if options == nil {
+		return nil, nil
+	}
+	if options.ConsecutiveFailures < 0 || options.Window < 0 || options.OpenDuration < 0 || options.HalfOpenProbes < 0 {
+		return nil, proxyError(fmt.Sprintf("Circuit breaker settings for endpoint with ID: %s cannot be negative", id))
+	}
+	if options.ErrorRate < 0 || options.ErrorRate > 100 {
+		return nil, proxyError(fmt.Sprintf("Circuit breaker error rate %v for endpoint with ID: %s must be between 0 and 100", options.ErrorRate, id))
+	}
+	if options.ConsecutiveFailures == 0 && options.ErrorRate == 0 {
+		return nil, proxyError(fmt.Sprintf("Circuit breaker for endpoint with ID: %s needs consecutive failures or an error rate", id))
+	}
+	c := &circuitBreaker{
+		consecutiveFailures: options.ConsecutiveFailures,
+		errorRate:           options.ErrorRate,
+		openDuration:        options.OpenDuration,
+		halfOpenProbes:      options.HalfOpenProbes,
+		state:               CircuitClosed,
+		now:                 time.Now,
+	}
+	window := options.Window
+	if window == 0 {
+		window = DefaultBreakerWindow
+	}
+	if c.errorRate > 0 {
+		c.outcomes = make([]bool, 0, window)
+	}
+	if c.openDuration == 0 {
+		c.openDuration = DefaultBreakerOpenDuration
+	}
+	if c.halfOpenProbes == 0 {
+		c.halfOpenProbes = DefaultHalfOpenProbes
+	}
+	return c, nil
+}
+
+func (c *circuitBreaker) transition(state string) string {
+	c.state = state
+	c.failures, c.probes, c.probeSuccesses = 0, 0, 0
+	c.outcomes, c.next = c.outcomes[:0], 0
+	if state == CircuitOpen {
+		c.openedAt = c.now()
+	}
+	return state
+}
+
+// allow reports whether a request may be sent, along with the state the
+// circuit moved to or an empty string when it did not change.
+func (c *circuitBreaker) allow() (bool, string) {
+	if c == nil {
+		return true, ""
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	changed := ""
+	if c.state == CircuitOpen {
+		if c.now().Sub(c.openedAt) < c.openDuration {
+			return false, ""
+		}
+		changed = c.transition(CircuitHalfOpen)
+	}
+	if c.state == CircuitHalfOpen {
+		if c.probes >= c.halfOpenProbes {
+			return false, changed
+		}
+		c.probes++
+	}
+	return true, changed
+}
+
+// record accounts for the outcome of an allowed request and returns the
+// state the circuit moved to, or an empty string when it did not change.
+func (c *circuitBreaker) record(success bool) string {
+	if c == nil {
+		return ""
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == CircuitHalfOpen {
+		if !success {
+			return c.transition(CircuitOpen)
+		}
+		if c.probeSuccesses++; c.probeSuccesses >= c.halfOpenProbes {
+			return c.transition(CircuitClosed)
+		}
+		return ""
+	}
+	if c.state != CircuitClosed {
+		return ""
+	}
+	if success {
+		c.failures = 0
+	} else {
+		c.failures++
+	}
+	if c.consecutiveFailures > 0 && c.failures >= c.consecutiveFailures {
+		return c.transition(CircuitOpen)
+	}
+	if c.errorRate > 0 {
+		if len(c.outcomes) < cap(c.outcomes) {
+			c.outcomes = append(c.outcomes, success)
+		} else {
+			c.outcomes[c.next] = success
+			c.next = (c.next + 1) % len(c.outcomes)
+		}
+		if len(c.outcomes) == cap(c.outcomes) {
+			failed := 0
+			for _, ok := range c.outcomes {
+				if !ok {
+					failed++
+				}
+			}
+			if float64(failed)*100 >= c.errorRate*float64(len(c.outcomes)) {
+				return c.transition(CircuitOpen)
+			}
+		}
+	}
+	return ""
+}
+
+func (c *circuitBreaker) currentState() string {
+	if c == nil {
+		return CircuitClosed
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitOpensOnConsecutiveFailures(t *testing.T) {
+	c, err := newCircuitBreaker("B1", &CircuitBreakerOptions{ConsecutiveFailures: 3, OpenDuration: time.Minute, HalfOpenProbes: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	for _, success := range []bool{false, false, true, false, false} {
+		if state := c.record(success); state != "" {
+			t.Fatalf("Expected circuit to stay closed. Actual: %s", state)
+		}
+	}
+	if state := c.record(false); state != CircuitOpen {
+		t.Fatalf("Expected circuit to open after 3 consecutive failures. Actual: %s", state)
+	}
+	if allowed, _ := c.allow(); allowed {
+		t.Error("Expected requests to be rejected while the circuit is open")
+	}
+
+	now = now.Add(time.Minute)
+	if allowed, state := c.allow(); !allowed || state != CircuitHalfOpen {
+		t.Errorf("Expected a probe once the circuit is half open. Actual: %v, %s", allowed, state)
+	}
+	if allowed, _ := c.allow(); !allowed {
+		t.Error("Expected a second probe")
+	}
+	if allowed, _ := c.allow(); allowed {
+		t.Error("Expected no more than 2 probes while half open")
+	}
+	if state := c.record(true); state != "" {
+		t.Errorf("Expected circuit to stay half open until all probes succeed. Actual: %s", state)
+	}
+	if state := c.record(true); state != CircuitClosed {
+		t.Errorf("Expected circuit to close after successful probes. Actual: %s", state)
+	}
+
+	c.transition(CircuitHalfOpen)
+	c.allow()
+	if state := c.record(false); state != CircuitOpen {
+		t.Errorf("Expected a failed probe to open the circuit again. Actual: %s", state)
+	}
+}
+
+func TestCircuitOpensOnErrorRate(t *testing.T) {
+	c, err := newCircuitBreaker("B1", &CircuitBreakerOptions{ErrorRate: 50, Window: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 9; i++ {
+		if state := c.record(i%2 == 0); state != "" {
+			t.Fatalf("Expected circuit to stay closed until the window is full. Actual: %s", state)
+		}
+	}
+	if state := c.record(false); state != CircuitOpen {
+		t.Errorf("Expected circuit to open at a 50%% error rate. Actual: %s", state)
+	}
+	for _, options := range []*CircuitBreakerOptions{{}, {ErrorRate: 120}, {ConsecutiveFailures: -1}} {
+		if _, err := newCircuitBreaker("B1", options); err == nil {
+			t.Errorf("Expected invalid circuit breaker settings to be rejected %+v", options)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Maximum number of body bytes written to the diff log for each side of a mismatch
+const MaxDiffBodyBytes = 1024
+
+// Maximum body size kept for comparison and recording. Larger responses
+// are still streamed to the client but are not compared.
+const MaxCapturedBodyBytes = 1 << 20
+
+type ComparisonOptions struct {
+	Enabled           bool               `yaml:"Enabled"`
+	Headers           []string           `yaml:"Headers"`
+	DiffLogFile       string             `yaml:"DiffLogFile"`
+	IgnorePaths       []string           `yaml:"IgnorePaths"`
+	NumericTolerance  float64            `yaml:"NumericTolerance"`
+	NumericTolerances map[string]float64 `yaml:"NumericTolerances"`
+}
+
+// capturedResponse is a backend response kept for comparison and
+// recording. The body is left out when it exceeds MaxCapturedBodyBytes.
+type capturedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	oversized  bool
+}
+
+// cappedBuffer keeps everything written to it up to a limit and drops
+// all of it once the limit is exceeded.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	oversized bool
+}
+
+type comparator struct {
+	headers []string
+	json    *jsonComparator
+	diffLog *log.Logger
+}
+
+func newComparator(options *ComparisonOptions) (*comparator, error) {
+	json_comparator, err := newJSONComparator(options)
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]string, len(options.Headers))
+	for i, h := range options.Headers {
+		headers[i] = http.CanonicalHeaderKey(h)
+	}
+	return &comparator{headers: headers, json: json_comparator, diffLog: log.New(diffLogFile, "DIFF:", log.Ldate|log.Ltime)}, nil
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if !b.oversized {
+		if b.buf.Len()+len(p) > b.limit {
+			b.oversized = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) response(res *http.Response) *capturedResponse {
+	captured := &capturedResponse{statusCode: res.StatusCode, header: res.Header, oversized: b.oversized}
+	if !b.oversized {
+		captured.body = b.buf.Bytes()
+	}
+	return captured
+}
+
+func captureResponse(res *http.Response) (*capturedResponse, error) {
+	defer res.Body.Close()
+	buf := &cappedBuffer{limit: MaxCapturedBodyBytes}
+	if _, err := io.Copy(buf, res.Body); err != nil {
+		return nil, err
+	}
+	return buf.response(res), nil
+}
+
+// streamResponse writes the response to the client as it is received and
+// captures it at the same time. Nothing is captured when the response
+// cannot be copied completely.
+func streamResponse(rw http.ResponseWriter, res *http.Response) *capturedResponse {
+	buf := &cappedBuffer{limit: MaxCapturedBodyBytes}
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(res.Body, buf), res.Body}
+	if err := copyResponse(rw, res); err != nil {
+		return nil
+	}
+	return buf.response(res)
+}
+
+// compare returns a human readable description of every difference
+// between the primary and secondary responses. An empty result means
+// the responses match.
+func (c *comparator) compare(primary, secondary *capturedResponse) []string {
+	var diffs []string
+	if primary.statusCode != secondary.statusCode {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", primary.statusCode, secondary.statusCode))
+	}
+	for _, h := range c.headers {
+		primary_value := strings.Join(primary.header[h], ",")
+		secondary_value := strings.Join(secondary.header[h], ",")
+		if primary_value != secondary_value {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", h, primary_value, secondary_value))
+		}
+	}
+	return append(diffs, c.compareBody(primary, secondary)...)
+}
+
+// compareBody compares JSON bodies structurally and falls back to a
+// byte comparison for any other content or for malformed JSON.
+func (c *comparator) compareBody(primary, secondary *capturedResponse) []string {
+	if isJSON(primary) || isJSON(secondary) {
+		if diffs, err := c.json.compare(primary.body, secondary.body); err == nil {
+			return diffs
+		}
+	}
+	if !bytes.Equal(primary.body, secondary.body) {
+		return []string{fmt.Sprintf("body: %q != %q", truncateBody(primary.body), truncateBody(secondary.body))}
+	}
+	return nil
+}
+
+func (c *comparator) logMismatch(req *http.Request, be *backend, diffs []string) {
+	c.diffLog.Printf("[%s] %s %s -> %s", be.id, req.Method, req.URL.String(), strings.Join(diffs, "; "))
+}
+
+func truncateBody(body []byte) string {
+	if len(body) > MaxDiffBodyBytes {
+		return string(body[:MaxDiffBodyBytes]) + "..."
+	}
+	return string(body)
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestComparator(headers ...string) *comparator {
+	if c, err := newComparator(&ComparisonOptions{Enabled: true, Headers: headers}); err != nil {
+		panic(err)
+	} else {
+		return c
+	}
+}
+
+func response(statusCode int, header http.Header, body string) *capturedResponse {
+	return &capturedResponse{statusCode: statusCode, header: header, body: []byte(body)}
+}
+
+func TestCompareMatchingResponses(t *testing.T) {
+	c := newTestComparator("Content-Type")
+	primary := response(200, http.Header{"Content-Type": {"text/plain"}, "Date": {"today"}}, "hello")
+	secondary := response(200, http.Header{"Content-Type": {"text/plain"}, "Date": {"tomorrow"}}, "hello")
+	if diffs := c.compare(primary, secondary); len(diffs) != 0 {
+		t.Errorf("Expected no differences. Actual: %v", diffs)
+	}
+}
+
+func TestCompareMismatchingResponses(t *testing.T) {
+	c := newTestComparator("content-type")
+	primary := response(200, http.Header{"Content-Type": {"text/plain"}}, "hello")
+	secondary := response(500, http.Header{"Content-Type": {"application/json"}}, "world")
+	if diffs := c.compare(primary, secondary); len(diffs) != 3 {
+		t.Errorf("Expected 3 differences. Actual: %v", diffs)
+	}
+}
+
+func TestCompareJSONIgnoresKeyOrderAndIgnoredPaths(t *testing.T) {
+	c, err := newComparator(&ComparisonOptions{
+		Enabled:           true,
+		IgnorePaths:       []string{"$.meta.requestId", "$.items[*].updatedAt"},
+		NumericTolerances: map[string]float64{"$.items[*].price": 0.01},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	primary := response(200, header, `{"meta":{"requestId":"a"},"items":[{"id":1,"price":9.99,"updatedAt":"t1"}]}`)
+	secondary := response(200, header, `{"items":[{"updatedAt":"t2","price":9.995,"id":1}],"meta":{"requestId":"b"}}`)
+	if diffs := c.compare(primary, secondary); len(diffs) != 0 {
+		t.Errorf("Expected no differences. Actual: %v", diffs)
+	}
+}
+
+func TestCompareJSONReportsPaths(t *testing.T) {
+	c := newTestComparator()
+	header := http.Header{"Content-Type": {"application/json"}}
+	primary := response(200, header, `{"items":[{"id":1}],"total":1}`)
+	secondary := response(200, header, `{"items":[{"id":2}]}`)
+	diffs := c.compare(primary, secondary)
+	expected := []string{"$.items[0].id: 1 != 2", "$.total: missing in secondary"}
+	if len(diffs) != len(expected) {
+		t.Fatalf("Expected differences: %v. Actual: %v", expected, diffs)
+	}
+	for i := range expected {
+		if diffs[i] != expected[i] {
+			t.Errorf("Expected difference: %s. Actual: %s", expected[i], diffs[i])
+		}
+	}
+}
+
+func TestCompareJSONLargeNumbersExactly(t *testing.T) {
+	c := newTestComparator()
+	header := http.Header{"Content-Type": {"application/json"}}
+	primary := response(200, header, `{"id":12345678901234567890,"price":1.0}`)
+	secondary := response(200, header, `{"id":12345678901234567891,"price":1}`)
+	if diffs := c.compare(primary, secondary); len(diffs) != 1 || diffs[0] != "$.id: 12345678901234567890 != 12345678901234567891" {
+		t.Errorf("Expected only the id to differ. Actual: %v", diffs)
+	}
+}
+
+func TestDecodeJSONRejectsTrailingData(t *testing.T) {
+	if _, err := decodeJSON([]byte(`{"id":1} {"id":2}`)); err == nil {
+		t.Error("Expected an error for data after the JSON value")
+	}
+	if _, err := decodeJSON([]byte("{\"id\":1}\n")); err != nil {
+		t.Errorf("Expected trailing whitespace to be accepted. Error: %v", err)
+	}
+}
+
+func TestInvalidIgnorePath(t *testing.T) {
+	if _, err := newComparator(&ComparisonOptions{Enabled: true, IgnorePaths: []string{"meta.id"}}); err == nil {
+		t.Error("Expected an error for an ignore path without '$'")
+	}
+}
+
+func TestStreamResponseSkipsComparisonOfLargeBodies(t *testing.T) {
+	large := strings.Repeat("a", MaxCapturedBodyBytes+1)
+	rw := httptest.NewRecorder()
+	primary := streamResponse(rw, &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(large))})
+	if rw.Body.String() != large {
+		t.Errorf("Expected the whole body to be streamed to the client. Actual length: %d", rw.Body.Len())
+	}
+	if primary == nil || !primary.oversized || primary.body != nil {
+		t.Fatalf("Expected an oversized response without a captured body. Actual: %+v", primary)
+	}
+	r := &Reporter{metrics: make(map[string]uint64)}
+	secondary := &http.Response{StatusCode: 500, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("error"))}
+	if diffs := compareResponse(newTestComparator(), r, httptest.NewRequest("GET", "http://localhost/", nil), &backend{id: "B1"}, primary, secondary); diffs != nil {
+		t.Errorf("Expected the comparison to be skipped. Actual: %v", diffs)
+	}
+	if r.metrics["secondary.compare_skipped.count"] != 1 || r.metrics["secondary.mismatch.count"] != 0 {
+		t.Errorf("Expected the skipped comparison to be counted. Actual: %v", r.metrics)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/KalyanAkella/director/internal/metrics"
+)
+
+// Defaults for the retry budget of fallback primaries
+const (
+	DefaultRetryBudget = 10.0
+	MaxRetryBurst      = 10.0
+)
+
+// FailoverOptions control when a request is retried on the fallbacks of
+// its primary. Requests that could not be sent because the connection
+// failed are always retried. Responses with one of the StatusCodes are
+// retried for idempotent methods only. Retries are limited to RetryBudget
+// percent of the requests, with bursts of up to 10 retries.
+type FailoverOptions struct {
+	StatusCodes []int   `yaml:"StatusCodes"`
+	RetryBudget float64 `yaml:"RetryBudget"`
+}
+
+// retryBudget earns a fraction of a retry for every request and spends
+// a whole one for every fallback attempt.
+type retryBudget struct {
+	lock    sync.Mutex
+	balance float64
+	ratio   float64
+}
+
+type failover struct {
+	statusCodes map[int]bool
+	budget      *retryBudget
+}
+
+func validateFailover(options *FailoverOptions) error {
+	if options == nil {
+		return nil
+	}
+	for _, code := range options.StatusCodes {
+		if code < 100 || code > 599 {
+			return proxyError(fmt.Sprintf("Invalid failover status code: %d", code))
+		}
+	}
+	if options.RetryBudget < 0 || options.RetryBudget > 100 {
+		return proxyError(fmt.Sprintf("Retry budget %v must be between 0 and 100", options.RetryBudget))
+	}
+	return nil
+}
+
+func newFailover(options *FailoverOptions) *failover {
+	f := &failover{statusCodes: make(map[int]bool), budget: &retryBudget{balance: MaxRetryBurst, ratio: DefaultRetryBudget / 100}}
+	if options != nil {
+		for _, code := range options.StatusCodes {
+			f.statusCodes[code] = true
+		}
+		if options.RetryBudget > 0 {
+			f.budget.ratio = options.RetryBudget / 100
+		}
+	}
+	return f
+}
+
+func (b *retryBudget) deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.balance = math.Min(MaxRetryBurst, b.balance+b.ratio)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// healthyFirst moves the backends failing their health checks to the end,
+// keeping the order of the healthy and of the unhealthy backends.
+func healthyFirst(backends []*backend) []*backend {
+	ordered := make([]*backend, 0, len(backends))
+	for _, be := range backends {
+		if be.health.isHealthy() {
+			ordered = append(ordered, be)
+		}
+	}
+	for _, be := range backends {
+		if !be.health.isHealthy() {
+			ordered = append(ordered, be)
+		}
+	}
+	return ordered
+}
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// shouldRetry only retries errors that happened before the request was
+// sent, as any other error, such as a response timeout, may have left the
+// request processed by the backend.
+func (f *failover) shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		var op_err *net.OpError
+		return errors.As(err, &op_err) && op_err.Op == "dial"
+	}
+	return f.statusCodes[res.StatusCode] && idempotentMethods[req.Method]
+}
+
+// requestToPrimary sends the request to the primary of the route and then
+// to its fallbacks in order, as long as the attempts fail and the retry
+// budget allows. It returns the response of the last attempt, the backend
+// that produced it and the latency of that attempt.
+func (f *failover) requestToPrimary(ctx context.Context, rt *route, req *http.Request, body []byte, reporter metrics.Reporter) (*http.Response, *backend, time.Duration, error) {
+	f.budget.deposit()
+	candidates := healthyFirst(append([]*backend{rt.primary}, rt.fallbacks...))
+	for i, be := range candidates {
+		primary_request := newRequest(ctx, req, body, be)
+		infoLog(fmt.Sprintf("Sending request to primary endpoint [%s]: %s", be.id, primary_request.URL.String()))
+		started := time.Now()
+		res, err := requestToBackend(primary_request, be, reporter, "primary")
+		latency := time.Since(started)
+		if i < len(candidates)-1 && f.shouldRetry(req, res, err) && ctx.Err() == nil && f.budget.withdraw() {
+			if res != nil {
+				res.Body.Close()
+			}
+			go reporter.With(metrics.Labels{"backend": be.id, "role": "primary"}).Increment("primary.failover.count")
+			go errorLog(fmt.Sprintf("Failing over from primary endpoint [%s] to [%s]", be.id, candidates[i+1].id))
+			continue
+		}
+		if err == nil {
+			go reporter.With(metrics.Labels{"backend": be.id, "role": "primary"}).Increment("primary.served.count")
+		}
+		return res, be, latency, err
+	}
+	return nil, nil, 0, proxyError("No primary endpoint to send the request to")
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailoverToFallbackPrimaries(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "served by fallback")
+	}))
+	defer healthy.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	config := &ProxyConfig{
+		Backends: map[string]*BackendConfig{
+			PrimaryTag: {URL: unavailable.URL},
+			"F1":       {URL: closed.URL},
+			"F2":       {URL: healthy.URL},
+		},
+		Options:  &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, FallbackEndpoints: []string{"F1", "F2"}, LogLevel: ERROR},
+		Failover: &FailoverOptions{StatusCodes: []int{http.StatusServiceUnavailable}},
+	}
+	if err := validate(config); err != nil {
+		t.Fatal(err)
+	}
+	rt := config.routes[0]
+	if len(rt.secondaries) != 0 {
+		t.Errorf("Expected fallbacks not to be mirrored to. Actual: %d secondaries", len(rt.secondaries))
+	}
+	f := newFailover(config.Failover)
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	res, be, _, err := f.requestToPrimary(req.Context(), rt, req, nil, &Reporter{metrics: make(map[string]uint64)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if be.id != "F2" || string(body) != "served by fallback" {
+		t.Errorf("Expected response from F2. Actual: [%s] %s", be.id, body)
+	}
+
+	f.budget.balance = 0
+	if res, be, _, _ = f.requestToPrimary(req.Context(), rt, req, nil, &Reporter{metrics: make(map[string]uint64)}); be.id != PrimaryTag || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the primary response once the retry budget is spent. Actual: [%s]", be.id)
+	}
+	res.Body.Close()
+}
+
+func TestFailoverOnlyRetriesUnsentOrIdempotentRequests(t *testing.T) {
+	var slow_hits, unavailable_hits, fallback_hits int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&slow_hits, 1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&unavailable_hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fallback_hits, 1)
+	}))
+	defer fallback.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	config := &ProxyConfig{
+		Backends: map[string]*BackendConfig{
+			"SLOW":   {URL: slow.URL, ResponseTimeout: 50 * time.Millisecond},
+			"CLOSED": {URL: closed.URL},
+			"BUSY":   {URL: unavailable.URL},
+			"F1":     {URL: fallback.URL},
+		},
+		Options:  &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: "SLOW", FallbackEndpoints: []string{"F1"}, LogLevel: ERROR},
+		Failover: &FailoverOptions{StatusCodes: []int{http.StatusServiceUnavailable}},
+	}
+	if err := validate(config); err != nil {
+		t.Fatal(err)
+	}
+	f := newFailover(config.Failover)
+	rt := config.routes[0]
+	send := func(method, primary string) (*backend, error) {
+		rt.primary = config.backends[primary]
+		req := httptest.NewRequest(method, "http://localhost/", nil)
+		res, be, _, err := f.requestToPrimary(req.Context(), rt, req, nil, &Reporter{metrics: make(map[string]uint64)})
+		if res != nil {
+			res.Body.Close()
+		}
+		return be, err
+	}
+
+	if _, err := send("POST", "SLOW"); err == nil || !isTimeout(err) {
+		t.Errorf("Expected the POST to time out. Error: %v", err)
+	}
+	if hits := atomic.LoadInt32(&slow_hits); hits != 1 {
+		t.Errorf("Expected the POST to be sent once. Actual: %d", hits)
+	}
+	if be, _ := send("POST", "BUSY"); be.id != "BUSY" {
+		t.Errorf("Expected the POST not to be retried on a failover status code. Actual: [%s]", be.id)
+	}
+	if be, _ := send("PUT", "BUSY"); be.id != "F1" {
+		t.Errorf("Expected the PUT to be retried on a failover status code. Actual: [%s]", be.id)
+	}
+	if be, err := send("POST", "CLOSED"); err != nil || be.id != "F1" {
+		t.Errorf("Expected the POST to be retried when the connection fails. Actual: [%v] %v", be, err)
+	}
+	if hits := atomic.LoadInt32(&fallback_hits); hits != 2 {
+		t.Errorf("Expected 2 requests to be served by the fallback. Actual: %d", hits)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	f := newFailover(&FailoverOptions{RetryBudget: 50})
+	for i := 0; i < MaxRetryBurst; i++ {
+		if !f.budget.withdraw() {
+			t.Fatalf("Expected a burst of %v retries. Actual: %d", MaxRetryBurst, i)
+		}
+	}
+	if f.budget.withdraw() {
+		t.Error("Expected the retry budget to be spent")
+	}
+	f.budget.deposit()
+	f.budget.deposit()
+	if !f.budget.withdraw() || f.budget.withdraw() {
+		t.Error("Expected one retry for every two requests at a budget of 50%")
+	}
+	if err := validateFailover(&FailoverOptions{StatusCodes: []int{42}}); err == nil {
+		t.Error("Expected an invalid status code to be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Methods mirrored by default once a filter is configured for a secondary
+var SafeMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace}
+
+// FilterOptions restrict the requests mirrored to a secondary backend.
+// When AllowMethods is empty only safe methods are mirrored. Paths are
+// regular expressions matched against the request path, and a request
+// matching a deny rule is never mirrored.
+type FilterOptions struct {
+	AllowMethods []string `yaml:"AllowMethods"`
+	DenyMethods  []string `yaml:"DenyMethods"`
+	AllowPaths   []string `yaml:"AllowPaths"`
+	DenyPaths    []string `yaml:"DenyPaths"`
+}
+
+type requestFilter struct {
+	allowMethods map[string]bool
+	denyMethods  map[string]bool
+	allowPaths   []*regexp.Regexp
+	denyPaths    []*regexp.Regexp
+}
+
+func methodSet(methods []string) map[string]bool {
+	set := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		set[strings.ToUpper(method)] = true
+	}
+	return set
+}
+
+func compilePaths(id string, patterns []string) ([]*regexp.Regexp, error) {
+	paths := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		if path, err := regexp.Compile(pattern); err != nil {
+			return nil, proxyError(fmt.Sprintf("Invalid path pattern: %s for endpoint with ID: %s. Error: %s", pattern, id, err.Error()))
+		} else {
+			paths[i] = path
+		}
+	}
+	return paths, nil
+}
+
+// newRequestFilter returns nil when no filter is configured, so that every request is mirrored
+func newRequestFilter(id string, options *FilterOptions) (*requestFilter, error) {
+	if options == nil {
+		return nil, nil
+	}
+	f := &requestFilter{allowMethods: methodSet(options.AllowMethods), denyMethods: methodSet(options.DenyMethods)}
+	if len(f.allowMethods) == 0 {
+		f.allowMethods = methodSet(SafeMethods)
+	}
+	var err error
+	if f.allowPaths, err = compilePaths(id, options.AllowPaths); err != nil {
+		return nil, err
+	}
+	if f.denyPaths, err = compilePaths(id, options.DenyPaths); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func matchesAny(paths []*regexp.Regexp, path string) bool {
+	for _, p := range paths {
+		if p.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the request may be mirrored
+func (f *requestFilter) allows(req *http.Request) bool {
+	if f == nil {
+		return true
+	}
+	if !f.allowMethods[req.Method] || f.denyMethods[req.Method] {
+		return false
+	}
+	if len(f.allowPaths) > 0 && !matchesAny(f.allowPaths, req.URL.Path) {
+		return false
+	}
+	return !matchesAny(f.denyPaths, req.URL.Path)
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFilterDefaultsToSafeMethods(t *testing.T) {
+	f, err := newRequestFilter("B1", &FilterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, expected := range map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "POST": false, "PUT": false, "DELETE": false} {
+		if actual := f.allows(httptest.NewRequest(method, "http://localhost/", nil)); actual != expected {
+			t.Errorf("Expected %s to be allowed: %v. Actual: %v", method, expected, actual)
+		}
+	}
+	var none *requestFilter
+	if !none.allows(httptest.NewRequest("DELETE", "http://localhost/", nil)) {
+		t.Error("Expected every request to be allowed without a filter")
+	}
+}
+
+func TestFilterMethodAndPathRules(t *testing.T) {
+	f, err := newRequestFilter("B1", &FilterOptions{
+		AllowMethods: []string{"get", "post"},
+		DenyMethods:  []string{"GET"},
+		AllowPaths:   []string{"^/api/"},
+		DenyPaths:    []string{"^/api/payments"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, expected := range map[string]bool{
+		"POST /api/orders":   true,
+		"GET /api/orders":    false,
+		"POST /health":       false,
+		"POST /api/payments": false,
+		"PUT /api/orders":    false,
+	} {
+		parts := strings.SplitN(target, " ", 2)
+		if actual := f.allows(httptest.NewRequest(parts[0], "http://localhost"+parts[1], nil)); actual != expected {
+			t.Errorf("Expected %s to be allowed: %v. Actual: %v", target, expected, actual)
+		}
+	}
+	if _, err := newRequestFilter("B1", &FilterOptions{DenyPaths: []string{"("}}); err == nil {
+		t.Error("Expected an invalid path pattern to be rejected")
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers describing the client of a proxied request
+var ForwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// forwarder adds the forwarding headers to requests sent to backends.
+// Incoming forwarding headers are only kept when the request comes from
+// one of the trusted proxies, otherwise they are replaced.
+type forwarder struct {
+	trusted []*net.IPNet
+}
+
+// newForwarder accepts trusted proxies as IP addresses or CIDR ranges
+func newForwarder(trusted []string) (*forwarder, error) {
+	f := &forwarder{}
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			if ip := net.ParseIP(t); ip == nil {
+				return nil, proxyError(fmt.Sprintf("Invalid trusted proxy: %s", t))
+			} else if ip.To4() != nil {
+				t += "/32"
+			} else {
+				t += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(t); err != nil {
+			return nil, proxyError(fmt.Sprintf("Invalid trusted proxy: %s. Error: %s", t, err.Error()))
+		} else {
+			f.trusted = append(f.trusted, network)
+		}
+	}
+	return f, nil
+}
+
+func (f *forwarder) isTrusted(ip net.IP) bool {
+	for _, network := range f.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedNode formats the client address as a node of the Forwarded header (RFC 7239)
+func forwardedNode(client string) string {
+	if strings.Contains(client, ":") {
+		return fmt.Sprintf("\"[%s]\"", client)
+	}
+	return client
+}
+
+// forward returns a shallow copy of the request carrying the forwarding headers
+func (f *forwarder) forward(req *http.Request) *http.Request {
+	out := new(http.Request)
+	*out = *req
+	out.Header = cloneHeader(req.Header)
+
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if ip := net.ParseIP(client); ip == nil || !f.isTrusted(ip) {
+		for _, h := range ForwardingHeaders {
+			out.Header.Del(h)
+		}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if prior := out.Header["X-Forwarded-For"]; len(prior) > 0 {
+		out.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+client)
+	} else {
+		out.Header.Set("X-Forwarded-For", client)
+	}
+	if out.Header.Get("X-Forwarded-Proto") == "" {
+		out.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if out.Header.Get("X-Forwarded-Host") == "" {
+		out.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	element := fmt.Sprintf("for=%s;host=%q;proto=%s", forwardedNode(client), req.Host, proto)
+	if prior := out.Header["Forwarded"]; len(prior) > 0 {
+		out.Header.Set("Forwarded", strings.Join(prior, ", ")+", "+element)
+	} else {
+		out.Header.Set("Forwarded", element)
+	}
+	return out
+}
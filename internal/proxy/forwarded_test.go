@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardingHeaders(t *testing.T) {
+	f, err := newForwarder([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming := func(remote string) *http.Request {
+		req := httptest.NewRequest("GET", "http://shop.example.com/items", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=203.0.113.7;proto=https")
+		return req
+	}
+
+	trusted := f.forward(incoming("10.1.2.3:4567"))
+	if v := trusted.Header.Get("X-Forwarded-For"); v != "203.0.113.7, 10.1.2.3" {
+		t.Errorf("Expected client to be appended to X-Forwarded-For. Actual: %s", v)
+	}
+	if v := trusted.Header.Get("X-Forwarded-Proto"); v != "https" {
+		t.Errorf("Expected X-Forwarded-Proto of a trusted proxy to be kept. Actual: %s", v)
+	}
+	if v := trusted.Header.Get("Forwarded"); v != `for=203.0.113.7;proto=https, for=10.1.2.3;host="shop.example.com";proto=http` {
+		t.Errorf("Unexpected Forwarded header. Actual: %s", v)
+	}
+
+	untrusted := incoming("192.0.2.1:4567")
+	forwarded := f.forward(untrusted)
+	if v := forwarded.Header.Get("X-Forwarded-For"); v != "192.0.2.1" {
+		t.Errorf("Expected X-Forwarded-For of an untrusted client to be replaced. Actual: %s", v)
+	}
+	if v := forwarded.Header.Get("X-Forwarded-Proto"); v != "http" {
+		t.Errorf("Expected X-Forwarded-Proto of an untrusted client to be replaced. Actual: %s", v)
+	}
+	if v := forwarded.Header.Get("X-Forwarded-Host"); v != "shop.example.com" {
+		t.Errorf("Expected X-Forwarded-Host to be the client host. Actual: %s", v)
+	}
+	if v := f.forward(incoming("[::1]:4567")).Header.Get("Forwarded"); v != `for=203.0.113.7;proto=https, for="[::1]";host="shop.example.com";proto=http` {
+		t.Errorf("Expected IPv6 node to be quoted. Actual: %s", v)
+	}
+	if untrusted.Header.Get("X-Forwarded-For") != "203.0.113.7" {
+		t.Error("Expected the incoming request to be left untouched")
+	}
+
+	if _, err := newForwarder([]string{"not-an-ip"}); err == nil {
+		t.Error("Expected an invalid trusted proxy to be rejected")
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import "net/http"
+
+// Header marking requests mirrored to a secondary backend
+const ShadowHeader = "X-Director-Shadow"
+
+// Headers removed when StripAuth is set
+var AuthHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// HeaderRules rewrite the headers of requests sent to a backend. Headers
+// are removed first, then set, then added. Secondaries get ShadowHeader
+// set before the rules apply, so it can be removed or overridden.
+type HeaderRules struct {
+	Add       map[string]string `yaml:"Add"`
+	Set       map[string]string `yaml:"Set"`
+	Remove    []string          `yaml:"Remove"`
+	StripAuth bool              `yaml:"StripAuth"`
+}
+
+func (r *HeaderRules) apply(header http.Header) {
+	if r == nil {
+		return
+	}
+	for _, h := range r.Remove {
+		header.Del(h)
+	}
+	if r.StripAuth {
+		for _, h := range AuthHeaders {
+			header.Del(h)
+		}
+	}
+	for k, v := range r.Set {
+		header.Set(k, v)
+	}
+	for k, v := range r.Add {
+		header.Add(k, v)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHeaderRulesForSecondary(t *testing.T) {
+	addr, _ := url.Parse("http://localhost:9192")
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Tenant", "live")
+	req.Header.Set("Accept", "text/plain")
+
+	primary := &backend{id: PrimaryTag, addr: addr}
+	if out := newRequest(context.Background(), req, nil, primary); out.Header.Get(ShadowHeader) != "" || out.Header.Get("Authorization") == "" {
+		t.Errorf("Expected primary request headers to be untouched. Actual: %v", out.Header)
+	}
+
+	secondary := &backend{id: "B1", addr: addr, shadow: true, rules: &HeaderRules{
+		Set:       map[string]string{"X-Tenant": "sandbox"},
+		Add:       map[string]string{"Accept": "application/json"},
+		Remove:    []string{"X-Unused"},
+		StripAuth: true,
+	}}
+	out := newRequest(context.Background(), req, nil, secondary)
+	if out.Header.Get(ShadowHeader) != "true" {
+		t.Errorf("Expected %s header on secondary request", ShadowHeader)
+	}
+	if out.Header.Get("Authorization") != "" || out.Header.Get("Cookie") != "" {
+		t.Errorf("Expected auth headers to be stripped. Actual: %v", out.Header)
+	}
+	if out.Header.Get("X-Tenant") != "sandbox" || len(out.Header["Accept"]) != 2 {
+		t.Errorf("Expected headers to be set and added. Actual: %v", out.Header)
+	}
+	if req.Header.Get("Authorization") == "" || req.Header.Get("X-Tenant") != "live" {
+		t.Errorf("Expected original request headers to be untouched. Actual: %v", req.Header)
+	}
+
+	secondary.rules = &HeaderRules{Remove: []string{ShadowHeader}}
+	if out := newRequest(context.Background(), req, nil, secondary); out.Header.Get(ShadowHeader) != "" {
+		t.Errorf("Expected %s header to be removable", ShadowHeader)
+	}
+}
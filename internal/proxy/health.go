@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KalyanAkella/director/internal/metrics"
+)
+
+// Defaults for the active health checks of a backend
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultUnhealthyThreshold  = 3
+	DefaultHealthyThreshold    = 1
+)
+
+// HealthCheckOptions probe a backend with a GET request to Path every
+// Interval. A backend is marked unhealthy after UnhealthyThreshold probes
+// in a row did not answer with ExpectedStatus within Timeout, and healthy
+// again after HealthyThreshold successful probes in a row.
+type HealthCheckOptions struct {
+	Path               string        `yaml:"Path"`
+	Interval           time.Duration `yaml:"Interval"`
+	Timeout            time.Duration `yaml:"Timeout"`
+	ExpectedStatus     int           `yaml:"ExpectedStatus"`
+	UnhealthyThreshold int           `yaml:"UnhealthyThreshold"`
+	HealthyThreshold   int           `yaml:"HealthyThreshold"`
+}
+
+// healthCheck holds the health of a backend as seen by its probes.
+// Backends start out healthy.
+type healthCheck struct {
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	expectedStatus     int
+	unhealthyThreshold int
+	healthyThreshold   int
+	unhealthy          int32
+	failures           int
+	successes          int
+	stopped            chan struct{}
+	done               sync.WaitGroup
+}
+
+// newHealthCheck returns nil when no health check is configured
+func newHealthCheck(id string, options *HealthCheckOptions) (*healthCheck, error) {
+	if options == nil {
+		return nil, nil
+	}
+	if options.Interval < 0 || options.Timeout < 0 || options.UnhealthyThreshold < 0 || options.HealthyThreshold < 0 {
+		return nil, proxyError(fmt.Sprintf("Health check settings for endpoint with ID: %s cannot be negative", id))
+	}
+	if options.ExpectedStatus != 0 && (options.ExpectedStatus < 100 || options.ExpectedStatus > 599) {
+		return nil, proxyError(fmt.Sprintf("Invalid expected health check status: %d for endpoint with ID: %s", options.ExpectedStatus, id))
+	}
+	h := &healthCheck{
+		path:               options.Path,
+		interval:           options.Interval,
+		timeout:            options.Timeout,
+		expectedStatus:     options.ExpectedStatus,
+		unhealthyThreshold: options.UnhealthyThreshold,
+		healthyThreshold:   options.HealthyThreshold,
+		stopped:            make(chan struct{}),
+	}
+	if h.interval == 0 {
+		h.interval = DefaultHealthCheckInterval
+	}
+	if h.timeout == 0 {
+		h.timeout = DefaultHealthCheckTimeout
+	}
+	if h.expectedStatus == 0 {
+		h.expectedStatus = http.StatusOK
+	}
+	if h.unhealthyThreshold == 0 {
+		h.unhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	if h.healthyThreshold == 0 {
+		h.healthyThreshold = DefaultHealthyThreshold
+	}
+	return h, nil
+}
+
+func (h *healthCheck) isHealthy() bool {
+	return h == nil || atomic.LoadInt32(&h.unhealthy) == 0
+}
+
+func (h *healthCheck) probe(be *backend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	target := *be.addr
+	target.Path = singleJoiningSlash(be.addr.Path, h.path)
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = be.host(req)
+	res, err := be.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode != h.expectedStatus {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// check probes the backend once and updates its health
+func (h *healthCheck) check(be *backend, reporter metrics.Reporter) {
+	err := h.probe(be)
+	if err == nil {
+		h.failures, h.successes = 0, h.successes+1
+	} else {
+		h.failures, h.successes = h.failures+1, 0
+	}
+	switch {
+	case err != nil && h.failures == h.unhealthyThreshold && h.isHealthy():
+		atomic.StoreInt32(&h.unhealthy, 1)
+		go reporter.With(metrics.Labels{"backend": be.id}).Increment("backend.unhealthy.count")
+		go errorLog(fmt.Sprintf("Endpoint [%s] is unhealthy. Error: %s", be.id, err.Error()))
+	case err == nil && h.successes == h.healthyThreshold && !h.isHealthy():
+		atomic.StoreInt32(&h.unhealthy, 0)
+		go reporter.With(metrics.Labels{"backend": be.id}).Increment("backend.healthy.count")
+		go infoLog(fmt.Sprintf("Endpoint [%s] is healthy again", be.id))
+	}
+}
+
+func (h *healthCheck) start(be *backend, reporter metrics.Reporter) {
+	h.done.Add(1)
+	go func() {
+		defer h.done.Done()
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			h.check(be, reporter)
+			select {
+			case <-ticker.C:
+			case <-h.stopped:
+				return
+			}
+		}
+	}()
+}
+
+func (h *healthCheck) stop() {
+	close(h.stopped)
+	h.done.Wait()
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthCheckThresholds(t *testing.T) {
+	var status int32 = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	be, err := newBackend("B1", &BackendConfig{URL: server.URL, HealthCheck: &HealthCheckOptions{Path: "/status", UnhealthyThreshold: 2, HealthyThreshold: 2}}, FullSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter := &Reporter{metrics: make(map[string]uint64)}
+	h := be.health
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	if h.check(be, reporter); !h.isHealthy() {
+		t.Error("Expected backend to stay healthy after a single failed probe")
+	}
+	if h.check(be, reporter); h.isHealthy() {
+		t.Error("Expected backend to be unhealthy after 2 failed probes")
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	if h.check(be, reporter); h.isHealthy() {
+		t.Error("Expected backend to stay unhealthy after a single successful probe")
+	}
+	if h.check(be, reporter); !h.isHealthy() {
+		t.Error("Expected backend to be healthy after 2 successful probes")
+	}
+}
+
+func TestUnhealthyPrimaryIsSkipped(t *testing.T) {
+	primary := &backend{id: PrimaryTag, health: &healthCheck{unhealthy: 1}}
+	fallback := &backend{id: "F1", health: &healthCheck{}}
+	other := &backend{id: "F2"}
+	if ordered := healthyFirst([]*backend{primary, fallback, other}); ordered[0] != fallback || ordered[1] != other || ordered[2] != primary {
+		t.Errorf("Expected healthy backends first. Actual: %s, %s, %s", ordered[0].id, ordered[1].id, ordered[2].id)
+	}
+
+	director := &director{}
+	director.state.Store(&directorState{
+		config: &ProxyConfig{backends: map[string]*backend{PrimaryTag: primary}},
+		routes: []*route{{primary: primary}},
+	})
+	rw := httptest.NewRecorder()
+	director.healthHandler(rw, httptest.NewRequest("GET", "/health", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected director to be unhealthy without a healthy primary. Actual: %d", rw.Code)
+	}
+}
+
+func TestHealthEndpointOnAdminListener(t *testing.T) {
+	config := func(admin string) *ProxyConfig {
+		return &ProxyConfig{
+			Backends: map[string]*BackendConfig{
+				PrimaryTag: {URL: "http://localhost:9191", HealthCheck: &HealthCheckOptions{Path: "/status"}},
+			},
+			Options: &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, LogLevel: ERROR, AdminListener: admin},
+		}
+	}
+	if director, err := NewDirector(config("")); err != nil {
+		t.Errorf("Expected health checks to be allowed without an admin listener. Error: %v", err)
+	} else {
+		director.currentState().stopHealthChecks()
+	}
+	director, err := NewDirector(config("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer director.currentState().stopHealthChecks()
+	rw := httptest.NewRecorder()
+	director.adminServer.Handler.ServeHTTP(rw, httptest.NewRequest("GET", "/health", nil))
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), PrimaryTag) {
+		t.Errorf("Expected /health to be served on the admin listener. Actual: %d %s", rw.Code, rw.Body.String())
+	}
+}
@@ -4,14 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/KalyanAkella/director/internal/metrics"
 )
@@ -24,28 +31,47 @@ const (
 )
 
 type ProxyOptions struct {
-	Port            int         `yaml:"Port"`
-	PrimaryEndpoint string      `yaml:"PrimaryEndpoint"`
-	LogFile         string      `yaml:"LogFile"`
-	LogLevel        LoggerLevel `yaml:"EnableInfoLogs"`
-	EnableStatsD    bool        `yaml:"EnableStatsD"`
-	StatsDService   string      `yaml:"StatsDService"`
-	metricsReporter metrics.Reporter
+	Port               int                 `yaml:"Port"`
+	PrimaryEndpoint    string              `yaml:"PrimaryEndpoint"`
+	LogFile            string              `yaml:"LogFile"`
+	LogLevel           LoggerLevel         `yaml:"EnableInfoLogs"`
+	EnableStatsD       bool                `yaml:"EnableStatsD"`
+	StatsDService      string              `yaml:"StatsDService"`
+	StatsDTagFormat    string              `yaml:"StatsDTagFormat"`
+	EnablePrometheus   bool                `yaml:"EnablePrometheus"`
+	PrometheusListener string              `yaml:"PrometheusListener"`
+	ShutdownTimeout    time.Duration       `yaml:"ShutdownTimeout"`
+	AdminListener      string              `yaml:"AdminListener"`
+	LatencyLogInterval time.Duration       `yaml:"LatencyLogInterval"`
+	TrustedProxies     []string            `yaml:"TrustedProxies"`
+	FallbackEndpoints  []string            `yaml:"FallbackEndpoints"`
+	TLS                *ListenerTLSOptions `yaml:"TLS"`
+	metricsReporter    metrics.Reporter
 }
 
 type ProxyConfig struct {
-	Options     *ProxyOptions     `yaml:"Options,omitempty"`
-	Backends    map[string]string `yaml:"Backends,omitempty"`
-	primary     *backend
-	secondaries []*backend
+	Options    *ProxyOptions             `yaml:"Options,omitempty"`
+	Backends   map[string]*BackendConfig `yaml:"Backends,omitempty"`
+	Comparison *ComparisonOptions        `yaml:"Comparison,omitempty"`
+	Sampling   *SamplingOptions          `yaml:"Sampling,omitempty"`
+	Recording  *RecordingOptions         `yaml:"Recording,omitempty"`
+	Routes     []*RouteConfig            `yaml:"Routes,omitempty"`
+	Failover   *FailoverOptions          `yaml:"Failover,omitempty"`
+	backends   map[string]*backend
+	routes     []*route
+	comparator *comparator
+	forwarder  *forwarder
 }
 
 var (
-	currentLogLevel = ERROR
-	logger          = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+	// currentLogLevel is 1 when info logs are enabled and is read and written atomically
+	currentLogLevel int32
+	proxyLogFile    = &logFile{}
+	diffLogFile     = &logFile{}
+	logger          = log.New(proxyLogFile, "", log.Ldate|log.Ltime|log.Lshortfile)
 
 	infoLog = func(msg string) {
-		if currentLogLevel == INFO {
+		if atomic.LoadInt32(&currentLogLevel) == 1 {
 			logger.SetPrefix("INFO:")
 			logger.Println(msg)
 		}
@@ -56,6 +82,11 @@ var (
 		logger.Println(msg)
 	}
 
+	statsLog = func(msg string) {
+		logger.SetPrefix("STATS:")
+		logger.Println(msg)
+	}
+
 	// Hop-by-hop headers. These are removed when sent to the backend.
 	// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
 	hopHeaders = []string{
@@ -71,16 +102,34 @@ var (
 	}
 )
 
-type backend struct {
-	id   string
-	addr *url.URL
+type director struct {
+	port          int
+	reporter      metrics.Reporter
+	state         atomic.Value
+	server        *http.Server
+	metricsServer *http.Server
+	recorder      *recorder
+	adminServer   *http.Server
+	serverTLS     *serverTLS
+	latencies     *latencyReport
+	counters      *backendCounters
+	mismatches    *mismatchLog
+	stopped       chan struct{}
+	logInterval   time.Duration
+	workers       sync.WaitGroup
 }
 
-type director struct {
-	port        int
-	reporter    metrics.Reporter
-	primary     *backend
-	secondaries []*backend
+// directorState holds everything that can be replaced by a configuration reload.
+// Requests use the state that was current when they were received.
+type directorState struct {
+	config          *ProxyConfig
+	routes          []*route
+	mirrors         map[string]*mirror
+	comparator      *comparator
+	forwarder       *forwarder
+	failover        *failover
+	sampler         *sampler
+	shutdownTimeout time.Duration
 }
 
 func proxyError(msg string) error {
@@ -100,46 +149,114 @@ func validate(config *ProxyConfig) error {
 	if config.Options == nil {
 		return proxyError("Proxy options are missing")
 	}
-	configureLogger(config.Options)
 	if config.Options.Port == 0 {
 		return proxyError("Proxy port is missing in proxy options")
 	}
-	if config.Options.EnableStatsD {
-		if metricsReporter, err := metrics.NewStatsDReporter("director", config.Options.StatsDService, handleStatsDFailure); err != nil {
-			return proxyError(fmt.Sprintf("Unable to configure StatsD client. Error: %s", err.Error()))
-		} else {
-			config.Options.metricsReporter = metricsReporter
-		}
-	} else {
-		config.Options.metricsReporter = metrics.NewNoopReporter()
+	if config.Options.EnablePrometheus && config.Options.PrometheusListener == "" {
+		return proxyError("Prometheus listener is missing in proxy options")
+	}
+	if err := validateListenerTLS(config.Options.TLS); err != nil {
+		return err
+	}
+	if config.Options.LatencyLogInterval < 0 {
+		return proxyError("Latency log interval cannot be negative")
+	}
+	if config.Options.ShutdownTimeout < 0 {
+		return proxyError("Shutdown timeout cannot be negative")
+	}
+	if len(config.Routes) > 0 && config.Options.PrimaryEndpoint != "" {
+		return proxyError("Primary endpoint cannot be combined with routes. Use a route without conditions instead")
 	}
-	if config.Options.PrimaryEndpoint == "" {
+	if len(config.Routes) == 0 && config.Options.PrimaryEndpoint == "" {
 		return proxyError("Primary endpoint is missing in proxy options")
 	}
 	if config.Backends == nil || len(config.Backends) == 0 {
 		return proxyError("Backends are missing or empty")
 	}
-	if _, present := config.Backends[config.Options.PrimaryEndpoint]; !present {
+	if _, present := config.Backends[config.Options.PrimaryEndpoint]; len(config.Routes) == 0 && !present {
 		return proxyError("Primary backend missing from the given set of backends")
 	}
+	primaries := primaryIDs(config)
+	if err := validateSampling(config, primaries); err != nil {
+		return err
+	}
+	if err := validateRecording(config.Recording); err != nil {
+		return err
+	}
+	if err := validateFailover(config.Failover); err != nil {
+		return err
+	}
+	config.backends = make(map[string]*backend, len(config.Backends))
 	for k, v := range config.Backends {
-		if v == "" {
-			return proxyError(fmt.Sprintf("Backend endpoint with ID: %s does not have any associated data", k))
-		} else {
-			if backend_url, err := url.Parse(v); err != nil {
-				return proxyError(fmt.Sprintf("Invalid url: %s for endpoint with ID: %s. Error: %s", v, k, err.Error()))
+		if primaries[k] {
+			if v != nil && !v.isEnabled() {
+				return proxyError(fmt.Sprintf("Primary backend with ID: %s cannot be disabled", k))
+			}
+			if v != nil && (v.Filter != nil || v.CircuitBreaker != nil) {
+				return proxyError(fmt.Sprintf("Filter and circuit breaker cannot be applied to the primary backend with ID: %s", k))
+			}
+			if primary, err := newBackend(k, v, FullSampleRate); err != nil {
+				return err
 			} else {
-				if k == config.Options.PrimaryEndpoint {
-					config.primary = &backend{k, backend_url}
-				} else {
-					config.secondaries = append(config.secondaries, &backend{k, backend_url})
-				}
+				config.backends[k] = primary
+			}
+		} else if v == nil || v.isEnabled() {
+			if secondary, err := newBackend(k, v, sampleRate(config, k)); err != nil {
+				return err
+			} else {
+				secondary.shadow = true
+				config.backends[k] = secondary
 			}
 		}
 	}
+	if routes, err := newRoutes(config); err != nil {
+		return err
+	} else {
+		config.routes = routes
+	}
+	if forwarder, err := newForwarder(config.Options.TrustedProxies); err != nil {
+		return err
+	} else {
+		config.forwarder = forwarder
+	}
+	if config.Comparison != nil && config.Comparison.Enabled {
+		if comparator, err := newComparator(config.Comparison); err != nil {
+			return proxyError(fmt.Sprintf("Unable to configure response comparison. Error: %s", err.Error()))
+		} else {
+			config.comparator = comparator
+		}
+	}
 	return nil
 }
 
+func configureReporter(options *ProxyOptions) (*http.Server, error) {
+	var reporters []metrics.Reporter
+	var metricsServer *http.Server
+	if options.EnableStatsD {
+		if metricsReporter, err := metrics.NewStatsDReporter("director", options.StatsDService, options.StatsDTagFormat, handleStatsDFailure); err != nil {
+			return nil, proxyError(fmt.Sprintf("Unable to configure StatsD client. Error: %s", err.Error()))
+		} else {
+			reporters = append(reporters, metricsReporter)
+		}
+	}
+	if options.EnablePrometheus {
+		metricsReporter := metrics.NewPrometheusReporter("director")
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsReporter.Handler())
+		metricsServer = &http.Server{Addr: options.PrometheusListener, Handler: mux}
+		reporters = append(reporters, metricsReporter)
+	}
+	switch len(reporters) {
+	case 0:
+		options.metricsReporter = metrics.NewNoopReporter()
+	case 1:
+		options.metricsReporter = reporters[0]
+	default:
+		options.metricsReporter = metrics.NewMultiReporter(reporters...)
+	}
+	return metricsServer, nil
+}
+
 func cloneHeader(h http.Header) http.Header {
 	h2 := make(http.Header, len(h))
 	for k, vv := range h {
@@ -150,15 +267,101 @@ func cloneHeader(h http.Header) http.Header {
 	return h2
 }
 
-func configureLogger(options *ProxyOptions) {
-	currentLogLevel = options.LogLevel
-	proxyLogFile := options.LogFile
-	if proxyLogFile != "" {
-		if logFile, err := os.OpenFile(proxyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err == nil {
-			logger.SetOutput(logFile)
-		} else {
-			errorLog(err.Error())
+// logFile is a log output that writes to stdout until a file is set. The
+// file is only reopened when its path changes, so that reloads do not leak
+// file handles.
+type logFile struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+// setPath switches the output to the given file, or to stdout when the
+// path is empty, and closes the previous file. The current output is kept
+// when the new file cannot be opened.
+func (l *logFile) setPath(path string) error {
+	if file, err := l.open(path); err != nil {
+		return err
+	} else {
+		l.switchTo(path, file)
+		return nil
+	}
+}
+
+// open opens the file at the given path without using it yet. No file is
+// opened when the path is empty or is the current one.
+func (l *logFile) open(path string) (*os.File, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if path == "" || path == l.path {
+		return nil, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// switchTo replaces the output with a file returned by open for the same path.
+func (l *logFile) switchTo(path string, file *os.File) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if path == l.path {
+		if file != nil {
+			file.Close()
 		}
+		return
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.path, l.file = path, file
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return os.Stdout.Write(p)
+	}
+	return l.file.Write(p)
+}
+
+func configureLogger(options *ProxyOptions) {
+	setLogLevel(options)
+	if err := proxyLogFile.setPath(options.LogFile); err != nil {
+		errorLog(err.Error())
+	}
+}
+
+func setLogLevel(options *ProxyOptions) {
+	if options.LogLevel == INFO {
+		atomic.StoreInt32(&currentLogLevel, 1)
+	} else {
+		atomic.StoreInt32(&currentLogLevel, 0)
+	}
+}
+
+// configureDiffLog directs the mismatches found by the comparison to the diff log file, if any
+func configureDiffLog(config *ProxyConfig) error {
+	path := diffLogPath(config)
+	if file, err := openDiffLog(path); err != nil {
+		return err
+	} else {
+		diffLogFile.switchTo(path, file)
+		return nil
+	}
+}
+
+func diffLogPath(config *ProxyConfig) string {
+	if config.Comparison != nil && config.Comparison.Enabled {
+		return config.Comparison.DiffLogFile
+	}
+	return ""
+}
+
+func openDiffLog(path string) (*os.File, error) {
+	if file, err := diffLogFile.open(path); err != nil {
+		return nil, proxyError(fmt.Sprintf("Unable to open diff log file %s. Error: %s", path, err.Error()))
+	} else {
+		return file, nil
 	}
 }
 
@@ -191,13 +394,16 @@ func modifyRequestForProxy(out_req *http.Request, target *url.URL) {
 	out_req.Host = ""
 }
 
-func newRequest(req *http.Request, req_body []byte, req_url *url.URL) *http.Request {
-	new_req := req.WithContext(context.Background())
+func newRequest(ctx context.Context, req *http.Request, req_body []byte, be *backend) *http.Request {
+	new_req := req.WithContext(ctx)
+	new_url := *req.URL
+	new_req.URL = &new_url
 
 	new_req.ContentLength = int64(len(req_body))
 	new_req.Body = ioutil.NopCloser(bytes.NewReader(req_body))
 	new_req.Header = cloneHeader(req.Header)
-	modifyRequestForProxy(new_req, req_url)
+	modifyRequestForProxy(new_req, be.addr)
+	new_req.Host = be.host(req)
 	new_req.Close = false
 
 	for _, h := range hopHeaders {
@@ -214,28 +420,95 @@ func newRequest(req *http.Request, req_body []byte, req_url *url.URL) *http.Requ
 			}
 		}
 	}
+	for k, v := range be.headers {
+		new_req.Header.Set(k, v)
+	}
+	if be.shadow {
+		new_req.Header.Set(ShadowHeader, "true")
+	}
+	be.rules.apply(new_req.Header)
 	return new_req
 }
 
-const MaxIdleConnsPerHost = 100
+const (
+	MaxIdleConnsPerHost    = 100
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// cancelOnClose releases the context of a request with a timeout once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// standardMethods are reported as is in the method label. Any other
+// method is reported as other, so clients cannot create new series.
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+func methodLabel(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+func statusClass(statusCode int) string {
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
 
 func requestToBackend(req *http.Request, be *backend, reporter metrics.Reporter, metricPrefix string) (*http.Response, error) {
+	labels := metrics.Labels{"backend": be.id, "role": metricPrefix}
 	tc := reporter.StartTiming()
-	defer reporter.EndTiming(tc, fmt.Sprintf("%s.response_time", metricPrefix))
-	transport := http.DefaultTransport
-	//transport.(*http.Transport).MaxIdleConns = MaxIdleConns /* do NOT set for unlimited idle conns */
-	transport.(*http.Transport).MaxIdleConnsPerHost = MaxIdleConnsPerHost
-	if res, err := transport.RoundTrip(req); err == nil {
+	cancel := context.CancelFunc(func() {})
+	if be.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), be.timeout)
+		req = req.WithContext(ctx)
+	}
+	res, err := be.transport.RoundTrip(req)
+	if err == nil {
+		labels["status"] = strconv.Itoa(res.StatusCode)
+		labels["status_class"] = statusClass(res.StatusCode)
+	}
+	reporter = reporter.With(labels)
+	reporter.EndTiming(tc, fmt.Sprintf("%s.response_time", metricPrefix))
+	if err == nil {
+		res.Body = &cancelOnClose{res.Body, cancel}
 		go infoLog(fmt.Sprintf("Received response with status %d from [%s]:[%s]", res.StatusCode, be.id, be.addr))
 		go reporter.Increment(fmt.Sprintf("%s.success.count", metricPrefix))
 		return res, nil
 	} else {
-		go reporter.Increment(fmt.Sprintf("%s.failure.count", metricPrefix))
+		if isTimeout(err) {
+			go reporter.Increment(fmt.Sprintf("%s.timeout.count", metricPrefix))
+		} else {
+			go reporter.Increment(fmt.Sprintf("%s.failure.count", metricPrefix))
+		}
 		go errorLog(fmt.Sprintf("Error response from [%s]:[%s] -> %s", be.id, be.addr, err.Error()))
+		cancel()
 		return nil, err
 	}
 }
 
+func isTimeout(err error) bool {
+	var net_err net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &net_err) && net_err.Timeout()
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -244,17 +517,19 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-func copyResponse(rw http.ResponseWriter, res *http.Response) {
+func copyResponse(rw http.ResponseWriter, res *http.Response) error {
 	copyHeader(rw.Header(), res.Header)
 	rw.WriteHeader(res.StatusCode)
 	defer res.Body.Close()
 	buf := make([]byte, 32*1024)
-	if _, err := io.CopyBuffer(rw, res.Body, buf); err != nil {
+	_, err := io.CopyBuffer(rw, res.Body, buf)
+	if err != nil {
 		fmt.Fprintln(rw, string(err.Error()))
 	}
 	if f, ok := rw.(http.Flusher); ok {
 		f.Flush()
 	}
+	return err
 }
 
 func logResponse(res *http.Response) {
@@ -276,45 +551,345 @@ func readRequestBody(req *http.Request) []byte {
 }
 
 func (b *director) handler(rw http.ResponseWriter, req *http.Request) {
-	go b.reporter.Increment("director.request.count")
+	state := b.currentState()
+	rt := matchRoute(state.routes, req)
+	if rt == nil {
+		go b.reporter.With(metrics.Labels{"method": methodLabel(req.Method)}).Increment("director.unrouted.count")
+		go infoLog("No route for request: " + req.URL.String())
+		http.NotFound(rw, req)
+		return
+	}
+	reporter := b.reporter.With(metrics.Labels{"method": methodLabel(req.Method), "route": rt.label()})
+	go reporter.Increment("director.request.count")
 	go infoLog("Received request: " + req.URL.String())
 
-	primary_backend := b.primary
 	body := readRequestBody(req)
-	primary_request := newRequest(req, body, primary_backend.addr)
-	go infoLog(fmt.Sprintf("Sending request to primary endpoint [%s]: %s", primary_backend.id, primary_request.URL.String()))
-	if res, err := requestToBackend(primary_request, primary_backend, b.reporter, "primary"); err == nil {
-		copyResponse(rw, res)
+	forwarded_req := state.forwarder.forward(req)
+	var primary_response *capturedResponse
+	var primary_latency time.Duration
+	if res, _, latency, err := state.failover.requestToPrimary(req.Context(), rt, forwarded_req, body, reporter); err == nil {
+		primary_latency = latency
+		if state.comparator == nil && b.recorder == nil {
+			copyResponse(rw, res)
+		} else {
+			primary_response = streamResponse(rw, res)
+		}
+	} else if isTimeout(err) {
+		rw.WriteHeader(http.StatusGatewayTimeout)
+		fmt.Fprintln(rw, string(err.Error()))
 	} else {
 		rw.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintln(rw, string(err.Error()))
 	}
 
-	go func() {
-		for _, secondary_backend := range b.secondaries {
-			secondary_request := newRequest(req, body, secondary_backend.addr)
-			infoLog(fmt.Sprintf("Sending request to secondary endpoint [%s]: %s", secondary_backend.id, secondary_request.URL.String()))
-			go func() {
-				if res, _ := requestToBackend(secondary_request, secondary_backend, b.reporter, "secondary"); res != nil {
-					logResponse(res)
-				}
-			}()
+	if b.recorder != nil {
+		b.recorder.record(req, body, primary_response)
+	}
+	for _, secondary := range rt.secondaries {
+		m := state.mirrors[secondary.id]
+		if !m.be.health.isHealthy() {
+			go reporter.With(metrics.Labels{"backend": m.be.id, "role": "secondary"}).Increment("secondary.unhealthy.count")
+			continue
 		}
-	}()
+		if !m.be.filter.allows(req) {
+			go reporter.With(metrics.Labels{"backend": m.be.id, "role": "secondary"}).Increment("secondary.skipped.count")
+			continue
+		}
+		if m.isPaused() {
+			go reporter.With(metrics.Labels{"backend": m.be.id, "role": "secondary"}).Increment("secondary.paused.count")
+			continue
+		}
+		if !state.sampler.sample(req, m.sampleRate()) {
+			go reporter.With(metrics.Labels{"backend": m.be.id, "role": "secondary"}).Increment("secondary.sampled_out.count")
+			continue
+		}
+		if dropped := m.offer(&replay{forwarded_req, body, primary_response, primary_latency, state.comparator, reporter}); dropped {
+			go reporter.With(metrics.Labels{"backend": m.be.id, "role": "secondary"}).Increment("secondary.dropped.count")
+			go errorLog(fmt.Sprintf("Replay queue for secondary endpoint [%s] is full. Dropping request", m.be.id))
+		}
+	}
+}
+
+func reportCircuit(reporter metrics.Reporter, be *backend, state string) {
+	if state != "" {
+		go reporter.With(metrics.Labels{"backend": be.id, "role": "secondary"}).Increment(fmt.Sprintf("secondary.circuit_%s.count", state))
+		go errorLog(fmt.Sprintf("Circuit breaker of secondary endpoint [%s] is now %s", be.id, state))
+	}
+}
+
+func (b *director) replay(secondary_backend *backend, r *replay) {
+	allowed, state := secondary_backend.breaker.allow()
+	reportCircuit(r.reporter, secondary_backend, state)
+	if !allowed {
+		go r.reporter.With(metrics.Labels{"backend": secondary_backend.id, "role": "secondary"}).Increment("secondary.short_circuited.count")
+		return
+	}
+	secondary_request := newRequest(context.Background(), r.req, r.body, secondary_backend)
+	infoLog(fmt.Sprintf("Sending request to secondary endpoint [%s]: %s", secondary_backend.id, secondary_request.URL.String()))
+	started := time.Now()
+	res, err := requestToBackend(secondary_request, secondary_backend, r.reporter, "secondary")
+	reportCircuit(r.reporter, secondary_backend, secondary_backend.breaker.record(err == nil))
+	if res != nil {
+		if r.primary_latency > 0 {
+			b.latencies.add(secondary_backend.id, r.primary_latency, time.Since(started))
+		}
+		if r.comparator == nil || r.primary_response == nil {
+			logResponse(res)
+		} else if diffs := compareResponse(r.comparator, r.reporter, r.req, secondary_backend, r.primary_response, res); len(diffs) > 0 {
+			b.mismatches.add(r.req, secondary_backend, diffs)
+		}
+	}
+}
+
+// compareResponse reports whether the secondary response matches the
+// primary one and returns the differences found.
+func compareResponse(c *comparator, reporter metrics.Reporter, req *http.Request, be *backend, primary_response *capturedResponse, res *http.Response) []string {
+	secondary_response, err := captureResponse(res)
+	if err != nil {
+		errorLog(fmt.Sprintf("An error occurred while reading response from [%s]:[%s]. Error: %s", be.id, be.addr, err.Error()))
+		return nil
+	}
+	if primary_response.oversized || secondary_response.oversized {
+		reporter.With(metrics.Labels{"backend": be.id, "role": "secondary"}).Increment("secondary.compare_skipped.count")
+		infoLog(fmt.Sprintf("Skipping comparison of response from [%s] for %s. Body exceeds %d bytes", be.id, req.URL.String(), MaxCapturedBodyBytes))
+		return nil
+	}
+	diffs := c.compare(primary_response, secondary_response)
+	if len(diffs) == 0 {
+		reporter.With(metrics.Labels{"backend": be.id, "role": "secondary"}).Increment("secondary.match.count")
+	} else {
+		reporter.With(metrics.Labels{"backend": be.id, "role": "secondary"}).Increment("secondary.mismatch.count")
+		c.logMismatch(req, be, diffs)
+	}
+	return diffs
+}
+
+func (b *director) newDirectorState(proxyConfig *ProxyConfig) *directorState {
+	mirrors := make(map[string]*mirror)
+	for _, r := range proxyConfig.routes {
+		for _, secondary := range r.secondaries {
+			if _, present := mirrors[secondary.id]; !present {
+				mirrors[secondary.id] = newMirror(secondary, b.replay, &b.workers)
+			}
+		}
+	}
+	shutdownTimeout := proxyConfig.Options.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	return &directorState{
+		config:          proxyConfig,
+		routes:          proxyConfig.routes,
+		mirrors:         mirrors,
+		comparator:      proxyConfig.comparator,
+		forwarder:       proxyConfig.forwarder,
+		failover:        newFailover(proxyConfig.Failover),
+		sampler:         newSampler(proxyConfig.Sampling),
+		shutdownTimeout: shutdownTimeout,
+	}
 }
 
 func NewDirector(proxyConfig *ProxyConfig) (*director, error) {
 	if err := validate(proxyConfig); err != nil {
 		return nil, err
 	}
-	return &director{
-		port:        proxyConfig.Options.Port,
-		reporter:    proxyConfig.Options.metricsReporter,
-		primary:     proxyConfig.primary,
-		secondaries: proxyConfig.secondaries,
-	}, nil
+	if err := configureDiffLog(proxyConfig); err != nil {
+		return nil, err
+	}
+	configureLogger(proxyConfig.Options)
+	metricsServer, err := configureReporter(proxyConfig.Options)
+	if err != nil {
+		return nil, err
+	}
+	counters := newBackendCounters()
+	b := &director{
+		port:          proxyConfig.Options.Port,
+		reporter:      metrics.NewMultiReporter(proxyConfig.Options.metricsReporter, &countingReporter{counters: counters}),
+		metricsServer: metricsServer,
+		latencies:     newLatencyReport(),
+		counters:      counters,
+		mismatches:    newMismatchLog(RecentMismatchesSize),
+		stopped:       make(chan struct{}),
+		logInterval:   proxyConfig.Options.LatencyLogInterval,
+	}
+	if proxyConfig.Options.AdminListener != "" {
+		b.adminServer = newAdminServer(proxyConfig.Options.AdminListener, b)
+	}
+	if proxyConfig.Recording != nil && proxyConfig.Recording.Enabled {
+		if b.recorder, err = newRecorder(proxyConfig.Recording, b.reporter); err != nil {
+			return nil, err
+		}
+	}
+	b.server = &http.Server{Addr: fmt.Sprintf(":%d", b.port), Handler: http.HandlerFunc(b.handler)}
+	if proxyConfig.Options.TLS != nil {
+		if b.serverTLS, err = newServerTLS(proxyConfig.Options.TLS); err != nil {
+			return nil, err
+		}
+		b.server.TLSConfig = b.serverTLS.tlsConfig()
+	}
+	state := b.newDirectorState(proxyConfig)
+	state.startHealthChecks(b.reporter)
+	b.state.Store(state)
+	return b, nil
+}
+
+func (b *director) currentState() *directorState {
+	return b.state.Load().(*directorState)
+}
+
+func (s *directorState) stopMirrors() {
+	for _, m := range s.mirrors {
+		m.stop()
+	}
+}
+
+func (s *directorState) startHealthChecks(reporter metrics.Reporter) {
+	for _, be := range s.config.backends {
+		if be.health != nil {
+			be.health.start(be, reporter)
+		}
+	}
+}
+
+func (s *directorState) stopHealthChecks() {
+	for _, be := range s.config.backends {
+		if be.health != nil {
+			be.health.stop()
+		}
+	}
+}
+
+// closeIdleConnections releases the connection pools of the backends once
+// they are no longer in use
+func (s *directorState) closeIdleConnections() {
+	for _, be := range s.config.backends {
+		be.transport.CloseIdleConnections()
+	}
+}
+
+// Reload validates the given configuration and atomically replaces the
+// backends, comparison and sampling settings of the running director,
+// and reloads the certificates of the listener. The certificates and log
+// files are loaded before anything is replaced, so the current
+// configuration is kept as a whole if any of them fails. Changes to the
+// port, metrics, recording settings and enabling TLS only take effect
+// after a restart.
+func (b *director) Reload(proxyConfig *ProxyConfig) error {
+	if err := validate(proxyConfig); err != nil {
+		return err
+	}
+	var tls_config *tls.Config
+	if (proxyConfig.Options.TLS != nil) != (b.serverTLS != nil) {
+		errorLog("Ignoring change of TLS on the director listener until restart")
+	} else if b.serverTLS != nil {
+		var err error
+		if tls_config, err = loadServerTLSConfig(proxyConfig.Options.TLS); err != nil {
+			return err
+		}
+	}
+	diff_log_path := diffLogPath(proxyConfig)
+	diff_log, err := openDiffLog(diff_log_path)
+	if err != nil {
+		return err
+	}
+	log_file, log_err := proxyLogFile.open(proxyConfig.Options.LogFile)
+	if log_err != nil {
+		errorLog(log_err.Error())
+	}
+
+	if proxyConfig.Options.Port != b.port {
+		errorLog(fmt.Sprintf("Ignoring change of port from %d to %d until restart", b.port, proxyConfig.Options.Port))
+	}
+	if tls_config != nil {
+		b.serverTLS.config.Store(tls_config)
+	}
+	diffLogFile.switchTo(diff_log_path, diff_log)
+	if log_err == nil {
+		proxyLogFile.switchTo(proxyConfig.Options.LogFile, log_file)
+	}
+	setLogLevel(proxyConfig.Options)
+	previous := b.currentState()
+	state := b.newDirectorState(proxyConfig)
+	state.startHealthChecks(b.reporter)
+	b.state.Store(state)
+	previous.stopMirrors()
+	previous.stopHealthChecks()
+	previous.closeIdleConnections()
+	infoLog(fmt.Sprintf("Reloaded configuration with %d routes and %d backends", len(proxyConfig.routes), len(proxyConfig.backends)))
+	return nil
 }
 
 func (b *director) ListenAndServe() error {
-	return http.ListenAndServe(fmt.Sprintf(":%d", b.port), http.HandlerFunc(b.handler))
+	if b.metricsServer != nil {
+		go func() {
+			if err := b.metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				errorLog(fmt.Sprintf("Metrics listener on %s stopped. Error: %v", b.metricsServer.Addr, err))
+			}
+		}()
+	}
+	if b.adminServer != nil {
+		go func() {
+			if err := b.adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				errorLog(fmt.Sprintf("Admin listener on %s stopped. Error: %v", b.adminServer.Addr, err))
+			}
+		}()
+	}
+	if b.logInterval > 0 {
+		go b.logLatencies()
+	}
+	if b.serverTLS != nil {
+		return b.server.ListenAndServeTLS("", "")
+	}
+	return b.server.ListenAndServe()
+}
+
+func (b *director) logLatencies() {
+	ticker := time.NewTicker(b.logInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.latencies.logSummaries()
+		case <-b.stopped:
+			return
+		}
+	}
+}
+
+// Shutdown stops accepting new connections, lets in-flight primary requests
+// complete and then waits for outstanding secondary replays, up to the
+// configured shutdown timeout in total, before flushing the capture file
+// and the metrics reporter.
+func (b *director) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), b.currentState().shutdownTimeout)
+	defer cancel()
+	defer b.reporter.Close()
+	if b.recorder != nil {
+		defer b.recorder.close()
+	}
+	close(b.stopped)
+	if b.metricsServer != nil {
+		defer b.metricsServer.Close()
+	}
+	if b.adminServer != nil {
+		defer b.adminServer.Close()
+	}
+	err := b.server.Shutdown(ctx)
+	b.currentState().stopMirrors()
+	b.currentState().stopHealthChecks()
+	if err != nil {
+		return proxyError(fmt.Sprintf("Unable to complete in-flight requests. Error: %s", err.Error()))
+	}
+	replays_done := make(chan struct{})
+	go func() {
+		b.workers.Wait()
+		close(replays_done)
+	}()
+	select {
+	case <-replays_done:
+		infoLog("All secondary replays completed")
+		return nil
+	case <-ctx.Done():
+		return proxyError("Timed out waiting for secondary replays to complete")
+	}
 }
@@ -8,8 +8,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -21,6 +24,8 @@ type Reporter struct {
 	m       sync.Mutex
 }
 
+func (r *Reporter) With(labels metrics.Labels) metrics.Reporter { return r }
+
 func (r *Reporter) Increment(tag string) {
 	r.m.Lock()
 	defer r.m.Unlock()
@@ -43,6 +48,8 @@ func (r *Reporter) StartTiming() *metrics.TimingContext { return nil }
 
 func (r *Reporter) EndTiming(tc *metrics.TimingContext, tag string) {}
 
+func (r *Reporter) Close() {}
+
 func (r *Reporter) Reset() {
 	r.m.Lock()
 	defer r.m.Unlock()
@@ -183,9 +190,9 @@ func startBackendServers() {
 }
 
 func startDirectorServer() {
-	servers := make(map[string]string, len(backendServers))
+	servers := make(map[string]*BackendConfig, len(backendServers))
 	for t, e := range backendServers {
-		servers[t] = fmt.Sprintf("http://%s", e)
+		servers[t] = &BackendConfig{URL: fmt.Sprintf("http://%s", e)}
 	}
 	if director, err := NewDirector(&ProxyConfig{
 		Backends: servers,
@@ -226,6 +233,25 @@ func assertMetric(tb testing.TB, expected_value int, metric_name string) {
 	}
 }
 
+// waitForMetric polls the test reporter until the metric reaches the
+// expected value, since metrics are incremented asynchronously
+func waitForMetric(tb testing.TB, expected_value int, metric_name string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		reporter.m.Lock()
+		actual_value := reporter.metrics[metric_name]
+		reporter.m.Unlock()
+		if actual_value == uint64(expected_value) {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Errorf("Metric name: %s. Expected: %d, Actual: %d", metric_name, expected_value, actual_value)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func TestHTTPGetWithFailureResponse(t *testing.T) {
 	backendServers = make(map[string]string)
 	backendServers["B1"] = "localhost:9094"
@@ -277,6 +303,133 @@ func TestHTTPGetWithSuccessResponse(t *testing.T) {
 	assertMetric(t, NumRequests, "director.request.count")
 }
 
+func TestReloadSwapsBackendsOnlyWhenValid(t *testing.T) {
+	config := func(secondary string) *ProxyConfig {
+		return &ProxyConfig{
+			Backends: map[string]*BackendConfig{
+				PrimaryTag: {URL: "http://localhost:9191"},
+				secondary:  {URL: "http://localhost:9192"},
+			},
+			Options: &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, LogLevel: ERROR},
+		}
+	}
+	director, err := NewDirector(config("B1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := director.Reload(config("B3")); err != nil {
+		t.Fatal(err)
+	}
+	if mirrors := director.currentState().mirrors; len(mirrors) != 1 || mirrors["B3"] == nil {
+		t.Errorf("Expected secondary B3 after reload. Actual: %v", mirrors)
+	}
+	invalid := config("B4")
+	invalid.Options.PrimaryEndpoint = "missing"
+	if err := director.Reload(invalid); err == nil {
+		t.Error("Expected reload with an invalid config to fail")
+	}
+	if mirrors := director.currentState().mirrors; len(mirrors) != 1 || mirrors["B3"] == nil {
+		t.Errorf("Expected secondary B3 to be kept after a failed reload. Actual: %v", mirrors)
+	}
+}
+
+func TestReloadReopensLogFilesOnlyWhenChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := func(name string) *ProxyConfig {
+		return &ProxyConfig{
+			Backends:   map[string]*BackendConfig{PrimaryTag: {URL: "http://localhost:9191"}},
+			Options:    &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, LogLevel: ERROR, LogFile: filepath.Join(dir, name+".log")},
+			Comparison: &ComparisonOptions{Enabled: true, DiffLogFile: filepath.Join(dir, name+"-diff.log")},
+		}
+	}
+	director, err := NewDirector(config("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configureLogger(&ProxyOptions{LogLevel: ERROR})
+	defer diffLogFile.setPath("")
+	log_file, diff_file := proxyLogFile.file, diffLogFile.file
+	if err := director.Reload(config("first")); err != nil {
+		t.Fatal(err)
+	}
+	if proxyLogFile.file != log_file || diffLogFile.file != diff_file {
+		t.Error("Expected the log files to be kept when their paths do not change")
+	}
+	if err := director.Reload(config("second")); err != nil {
+		t.Fatal(err)
+	}
+	if proxyLogFile.path != filepath.Join(dir, "second.log") || diffLogFile.path != filepath.Join(dir, "second-diff.log") {
+		t.Errorf("Expected the log files to be replaced. Actual: %s and %s", proxyLogFile.path, diffLogFile.path)
+	}
+	if err := log_file.Close(); err == nil {
+		t.Error("Expected the previous log file to be closed")
+	}
+	if err := diff_file.Close(); err == nil {
+		t.Error("Expected the previous diff log file to be closed")
+	}
+}
+
+func TestPrimaryTimeout(t *testing.T) {
+	slow_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow_server.Close()
+	director, err := NewDirector(&ProxyConfig{
+		Backends: map[string]*BackendConfig{PrimaryTag: {URL: slow_server.URL, Timeout: 50 * time.Millisecond}},
+		Options:  &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, LogLevel: ERROR},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter = &Reporter{metrics: make(map[string]uint64)}
+	director.reporter = reporter
+	rw := httptest.NewRecorder()
+	director.handler(rw, httptest.NewRequest("GET", "http://localhost/", nil))
+	assertStatusCode(t, rw.Code, http.StatusGatewayTimeout)
+	waitForMetric(t, 1, "primary.timeout.count")
+	reporter.m.Lock()
+	defer reporter.m.Unlock()
+	assertMetric(t, 0, "primary.failure.count")
+}
+
+func TestShutdownDrainsSecondaryReplays(t *testing.T) {
+	primary_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer primary_server.Close()
+	var replayed int32
+	secondary_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&replayed, 1)
+	}))
+	defer secondary_server.Close()
+	director, err := NewDirector(&ProxyConfig{
+		Backends: map[string]*BackendConfig{PrimaryTag: {URL: primary_server.URL}, "B1": {URL: secondary_server.URL, Workers: 1}},
+		Options:  &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, LogLevel: ERROR, ShutdownTimeout: 5 * time.Second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		rw := httptest.NewRecorder()
+		director.handler(rw, httptest.NewRequest("GET", "http://localhost/", nil))
+		assertStatusCode(t, rw.Code, http.StatusOK)
+	}
+	if err := director.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if count := atomic.LoadInt32(&replayed); count != 5 {
+		t.Errorf("Expected all 5 queued replays to complete before shutdown returns. Actual: %d", count)
+	}
+}
+
 func BenchmarkHTTPGet(b *testing.B) {
 	backendServers = make(map[string]string)
 	backendServers["B1"] = "localhost:9096"
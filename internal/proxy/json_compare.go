@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is a single step in a JSON path, either an object key or an array index.
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+type jsonPath []pathSegment
+
+func (p jsonPath) child(s pathSegment) jsonPath {
+	child := make(jsonPath, len(p), len(p)+1)
+	copy(child, p)
+	return append(child, s)
+}
+
+func (p jsonPath) String() string {
+	var sb strings.Builder
+	sb.WriteString("$")
+	for _, s := range p {
+		if s.isIndex {
+			sb.WriteString(fmt.Sprintf("[%d]", s.index))
+		} else {
+			sb.WriteString("." + s.key)
+		}
+	}
+	return sb.String()
+}
+
+// pathPattern is a parsed JSONPath-style rule such as $.items[*].updatedAt.
+// A key of "*" matches any object key and a wildcard index matches any array index.
+type pathPattern struct {
+	segments []pathSegment
+	wildcard []bool
+}
+
+func parsePathPattern(rule string) (*pathPattern, error) {
+	if !strings.HasPrefix(rule, "$") {
+		return nil, fmt.Errorf("path %q must start with '$'", rule)
+	}
+	pattern := &pathPattern{}
+	rest := rule[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("path %q has an empty key", rule)
+			}
+			pattern.segments = append(pattern.segments, pathSegment{key: key})
+			pattern.wildcard = append(pattern.wildcard, key == "*")
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unterminated index", rule)
+			}
+			index := rest[1:end]
+			if index == "*" {
+				pattern.segments = append(pattern.segments, pathSegment{isIndex: true})
+				pattern.wildcard = append(pattern.wildcard, true)
+			} else if i, err := strconv.Atoi(index); err != nil || i < 0 {
+				return nil, fmt.Errorf("path %q has an invalid index %q", rule, index)
+			} else {
+				pattern.segments = append(pattern.segments, pathSegment{index: i, isIndex: true})
+				pattern.wildcard = append(pattern.wildcard, false)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path %q has an unexpected character %q", rule, rest[0])
+		}
+	}
+	return pattern, nil
+}
+
+func (p *pathPattern) matches(path jsonPath) bool {
+	if len(p.segments) != len(path) {
+		return false
+	}
+	for i, s := range p.segments {
+		if s.isIndex != path[i].isIndex {
+			return false
+		}
+		if p.wildcard[i] {
+			continue
+		}
+		if s.isIndex && s.index != path[i].index || !s.isIndex && s.key != path[i].key {
+			return false
+		}
+	}
+	return true
+}
+
+type numericTolerance struct {
+	pattern   *pathPattern
+	tolerance float64
+}
+
+// jsonComparator compares JSON bodies structurally, ignoring key order,
+// the configured ignore paths and numeric differences within tolerance.
+type jsonComparator struct {
+	ignored          []*pathPattern
+	tolerances       []numericTolerance
+	defaultTolerance float64
+}
+
+func newJSONComparator(options *ComparisonOptions) (*jsonComparator, error) {
+	c := &jsonComparator{defaultTolerance: options.NumericTolerance}
+	for _, rule := range options.IgnorePaths {
+		if pattern, err := parsePathPattern(rule); err != nil {
+			return nil, err
+		} else {
+			c.ignored = append(c.ignored, pattern)
+		}
+	}
+	rules := make([]string, 0, len(options.NumericTolerances))
+	for rule := range options.NumericTolerances {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		if pattern, err := parsePathPattern(rule); err != nil {
+			return nil, err
+		} else {
+			c.tolerances = append(c.tolerances, numericTolerance{pattern, options.NumericTolerances[rule]})
+		}
+	}
+	return c, nil
+}
+
+func isJSON(res *capturedResponse) bool {
+	return strings.Contains(strings.ToLower(res.header.Get("Content-Type")), "json")
+}
+
+func decodeJSON(body []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return value, nil
+}
+
+// compare returns the differences between both JSON bodies, or an error
+// if either of them is not valid JSON.
+func (c *jsonComparator) compare(primary_body, secondary_body []byte) ([]string, error) {
+	primary_value, err := decodeJSON(primary_body)
+	if err != nil {
+		return nil, err
+	}
+	secondary_value, err := decodeJSON(secondary_body)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []string
+	c.diff(jsonPath{}, primary_value, secondary_value, &diffs)
+	return diffs, nil
+}
+
+func (c *jsonComparator) isIgnored(path jsonPath) bool {
+	for _, pattern := range c.ignored {
+		if pattern.matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *jsonComparator) toleranceFor(path jsonPath) float64 {
+	for _, t := range c.tolerances {
+		if t.pattern.matches(path) {
+			return t.tolerance
+		}
+	}
+	return c.defaultTolerance
+}
+
+func (c *jsonComparator) diff(path jsonPath, primary_value, secondary_value interface{}, diffs *[]string) {
+	if c.isIgnored(path) {
+		return
+	}
+	switch p := primary_value.(type) {
+	case map[string]interface{}:
+		s, ok := secondary_value.(map[string]interface{})
+		if !ok {
+			*diffs = append(*diffs, fmt.Sprintf("%s: object != %s", path, jsonType(secondary_value)))
+			return
+		}
+		keys := make([]string, 0, len(p)+len(s))
+		for k := range p {
+			keys = append(keys, k)
+		}
+		for k := range s {
+			if _, present := p[k]; !present {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := path.child(pathSegment{key: k})
+			pv, in_primary := p[k]
+			sv, in_secondary := s[k]
+			switch {
+			case c.isIgnored(child):
+			case !in_secondary:
+				*diffs = append(*diffs, fmt.Sprintf("%s: missing in secondary", child))
+			case !in_primary:
+				*diffs = append(*diffs, fmt.Sprintf("%s: missing in primary", child))
+			default:
+				c.diff(child, pv, sv, diffs)
+			}
+		}
+	case []interface{}:
+		s, ok := secondary_value.([]interface{})
+		if !ok {
+			*diffs = append(*diffs, fmt.Sprintf("%s: array != %s", path, jsonType(secondary_value)))
+			return
+		}
+		if len(p) != len(s) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: array length %d != %d", path, len(p), len(s)))
+		}
+		for i := 0; i < len(p) && i < len(s); i++ {
+			c.diff(path.child(pathSegment{index: i, isIndex: true}), p[i], s[i], diffs)
+		}
+	case json.Number:
+		s, ok := secondary_value.(json.Number)
+		if !ok {
+			*diffs = append(*diffs, fmt.Sprintf("%s: number != %s", path, jsonType(secondary_value)))
+			return
+		}
+		if p == s {
+			return
+		}
+		if !numbersEqual(p, s, c.toleranceFor(path)) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %s != %s", path, p, s))
+		}
+	default:
+		if primary_value != secondary_value {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", path, jsonValue(primary_value), jsonValue(secondary_value)))
+		}
+	}
+}
+
+// numbersEqual compares numbers exactly when there is no tolerance, since
+// large integers such as IDs cannot be represented as float64.
+func numbersEqual(p, s json.Number, tolerance float64) bool {
+	if tolerance == 0 {
+		pr, pok := new(big.Rat).SetString(string(p))
+		sr, sok := new(big.Rat).SetString(string(s))
+		return pok && sok && pr.Cmp(sr) == 0
+	}
+	pf, perr := p.Float64()
+	sf, serr := s.Float64()
+	return perr == nil && serr == nil && math.Abs(pf-sf) <= tolerance
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+func jsonValue(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	if str, ok := value.(string); ok {
+		return strconv.Quote(str)
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of most recent requests used to compare secondary and primary latencies
+const LatencyWindowSize = 10000
+
+// latencySample holds the primary and secondary latency of the same request.
+type latencySample struct {
+	primary   time.Duration
+	secondary time.Duration
+}
+
+// latencyTracker keeps a sliding window of latency samples for one secondary.
+type latencyTracker struct {
+	lock    sync.Mutex
+	samples []latencySample
+	next    int
+}
+
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50Ms"`
+	P90 float64 `json:"p90Ms"`
+	P99 float64 `json:"p99Ms"`
+}
+
+type LatencySummary struct {
+	Backend   string             `json:"backend"`
+	Samples   int                `json:"samples"`
+	Primary   LatencyPercentiles `json:"primary"`
+	Secondary LatencyPercentiles `json:"secondary"`
+	Delta     LatencyPercentiles `json:"delta"`
+}
+
+// latencyReport compares the latency of every secondary with the primary
+// latency for the same requests. It is kept across configuration reloads.
+type latencyReport struct {
+	lock     sync.Mutex
+	trackers map[string]*latencyTracker
+}
+
+// percentile returns the p-th percentile of the sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(float64(len(sorted))*p/100+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+func percentiles(latencies []time.Duration) LatencyPercentiles {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	millis := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return LatencyPercentiles{
+		P50: millis(percentile(latencies, 50)),
+		P90: millis(percentile(latencies, 90)),
+		P99: millis(percentile(latencies, 99)),
+	}
+}
+
+func (t *latencyTracker) add(primary, secondary time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.samples) < LatencyWindowSize {
+		t.samples = append(t.samples, latencySample{primary, secondary})
+	} else {
+		t.samples[t.next] = latencySample{primary, secondary}
+		t.next = (t.next + 1) % LatencyWindowSize
+	}
+}
+
+func (t *latencyTracker) summary(backend string) LatencySummary {
+	t.lock.Lock()
+	n := len(t.samples)
+	primary, secondary, delta := make([]time.Duration, n), make([]time.Duration, n), make([]time.Duration, n)
+	for i, s := range t.samples {
+		primary[i], secondary[i], delta[i] = s.primary, s.secondary, s.secondary-s.primary
+	}
+	t.lock.Unlock()
+	return LatencySummary{
+		Backend:   backend,
+		Samples:   n,
+		Primary:   percentiles(primary),
+		Secondary: percentiles(secondary),
+		Delta:     percentiles(delta),
+	}
+}
+
+func newLatencyReport() *latencyReport {
+	return &latencyReport{trackers: make(map[string]*latencyTracker)}
+}
+
+func (r *latencyReport) add(backend string, primary, secondary time.Duration) {
+	r.lock.Lock()
+	tracker, present := r.trackers[backend]
+	if !present {
+		tracker = &latencyTracker{}
+		r.trackers[backend] = tracker
+	}
+	r.lock.Unlock()
+	tracker.add(primary, secondary)
+}
+
+func (r *latencyReport) summaries() []LatencySummary {
+	r.lock.Lock()
+	backends := make([]string, 0, len(r.trackers))
+	for backend := range r.trackers {
+		backends = append(backends, backend)
+	}
+	r.lock.Unlock()
+	sort.Strings(backends)
+	summaries := make([]LatencySummary, len(backends))
+	for i, backend := range backends {
+		r.lock.Lock()
+		tracker := r.trackers[backend]
+		r.lock.Unlock()
+		summaries[i] = tracker.summary(backend)
+	}
+	return summaries
+}
+
+func (r *latencyReport) logSummaries() {
+	for _, s := range r.summaries() {
+		statsLog(fmt.Sprintf("Latency of secondary [%s] over %d requests. Delta to primary p50: %.2fms, p90: %.2fms, p99: %.2fms",
+			s.Backend, s.Samples, s.Delta.P50, s.Delta.P90, s.Delta.P99))
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+	for p, expected := range map[float64]time.Duration{50: 50 * time.Millisecond, 90: 90 * time.Millisecond, 99: 99 * time.Millisecond} {
+		if actual := percentile(latencies, p); actual != expected {
+			t.Errorf("Expected p%v to be %v. Actual: %v", p, expected, actual)
+		}
+	}
+}
+
+func TestLatencyReportComparesSecondaryWithPrimary(t *testing.T) {
+	report := newLatencyReport()
+	for i := 1; i <= LatencyWindowSize+100; i++ {
+		report.add("B1", 10*time.Millisecond, time.Duration(10+i%100)*time.Millisecond)
+	}
+	report.add("B3", 10*time.Millisecond, 5*time.Millisecond)
+	summaries := report.summaries()
+	if len(summaries) != 2 || summaries[0].Backend != "B1" || summaries[1].Backend != "B3" {
+		t.Fatalf("Unexpected summaries %+v", summaries)
+	}
+	if b1 := summaries[0]; b1.Samples != LatencyWindowSize || b1.Primary.P50 != 10 || b1.Delta.P50 != 49 || b1.Delta.P99 != 98 {
+		t.Errorf("Unexpected summary for B1 %+v", b1)
+	}
+	if b3 := summaries[1]; b3.Samples != 1 || b3.Delta.P90 != -5 {
+		t.Errorf("Unexpected summary for B3 %+v", b3)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// ListenerTLSOptions enable HTTPS on the director listener. Client
+// certificates are verified against ClientCAFile when given, and are
+// mandatory when RequireClientCert is set.
+type ListenerTLSOptions struct {
+	CertFile          string `yaml:"CertFile"`
+	KeyFile           string `yaml:"KeyFile"`
+	ClientCAFile      string `yaml:"ClientCAFile"`
+	RequireClientCert bool   `yaml:"RequireClientCert"`
+}
+
+// serverTLS holds the TLS configuration of the director listener so that
+// certificates can be replaced without restarting the listener.
+type serverTLS struct {
+	config atomic.Value
+}
+
+func validateListenerTLS(options *ListenerTLSOptions) error {
+	if options == nil {
+		return nil
+	}
+	if options.CertFile == "" || options.KeyFile == "" {
+		return proxyError("Certificate and key files are required for TLS on the director listener")
+	}
+	if options.RequireClientCert && options.ClientCAFile == "" {
+		return proxyError("Client CA file is required to verify client certificates")
+	}
+	return nil
+}
+
+func loadServerTLSConfig(options *ListenerTLSOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, proxyError(fmt.Sprintf("Unable to load certificate for the director listener. Error: %s", err.Error()))
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+	if options.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(options.ClientCAFile)
+		if err != nil {
+			return nil, proxyError(fmt.Sprintf("Unable to read client CA file %s. Error: %s", options.ClientCAFile, err.Error()))
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, proxyError(fmt.Sprintf("No certificates found in client CA file %s", options.ClientCAFile))
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if options.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+func newServerTLS(options *ListenerTLSOptions) (*serverTLS, error) {
+	s := &serverTLS{}
+	if err := s.load(options); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replaces the certificates used for new connections. The current
+// ones are kept when the new ones cannot be loaded.
+func (s *serverTLS) load(options *ListenerTLSOptions) error {
+	if config, err := loadServerTLSConfig(options); err != nil {
+		return err
+	} else {
+		s.config.Store(config)
+		return nil
+	}
+}
+
+func (s *serverTLS) current() *tls.Config {
+	return s.config.Load().(*tls.Config)
+}
+
+// tlsConfig is set on the listener and hands out the current certificates to every new connection
+func (s *serverTLS) tlsConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &s.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.current(), nil
+		},
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self signed certificate for localhost and its
+// key as <name>.pem and <name>-key.pem, and returns their paths.
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func clientFor(t *testing.T, caFile string, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	if ca, err := ioutil.ReadFile(caFile); err != nil {
+		t.Fatal(err)
+	} else {
+		pool.AppendCertsFromPEM(ca)
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}}}
+}
+
+func TestTLSListenerWithClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer primary.Close()
+	certFile, keyFile := writeCertificate(t, dir, "director")
+	clientCert, clientKey := writeCertificate(t, dir, "client")
+	config := func() *ProxyConfig {
+		return &ProxyConfig{
+			Backends: map[string]*BackendConfig{PrimaryTag: {URL: primary.URL}},
+			Options: &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, LogLevel: ERROR,
+				TLS: &ListenerTLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCert, RequireClientCert: true}},
+		}
+	}
+	director, err := NewDirector(config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go director.server.Serve(tls.NewListener(listener, director.server.TLSConfig))
+	defer director.server.Close()
+	url := "https://" + listener.Addr().String() + "/"
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := clientFor(t, certFile, cert).Get(url); err != nil {
+		t.Fatal(err)
+	} else {
+		res.Body.Close()
+		assertStatusCode(t, res.StatusCode, http.StatusOK)
+	}
+	if res, err := clientFor(t, certFile).Get(url); err == nil {
+		res.Body.Close()
+		t.Error("Expected requests without a client certificate to be rejected")
+	}
+
+	writeCertificate(t, dir, "director")
+	if err := director.Reload(config()); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := clientFor(t, certFile, cert).Get(url); err != nil {
+		t.Errorf("Expected the reloaded certificate to be served. Error: %s", err)
+	} else {
+		res.Body.Close()
+	}
+}
+
+func TestReloadKeepsConfigurationWhenCertificatesFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "director")
+	config := &ProxyConfig{
+		Backends: map[string]*BackendConfig{PrimaryTag: {URL: "http://localhost:9191"}},
+		Options: &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, LogLevel: ERROR,
+			TLS: &ListenerTLSOptions{CertFile: certFile, KeyFile: keyFile}},
+	}
+	director, err := NewDirector(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, certificates := director.currentState(), director.serverTLS.current()
+
+	diff_log := filepath.Join(dir, "diff.log")
+	config.Comparison = &ComparisonOptions{Enabled: true, DiffLogFile: diff_log}
+	config.Options.TLS = &ListenerTLSOptions{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key")}
+	if err := director.Reload(config); err == nil {
+		t.Fatal("Expected the reload to fail without the key file")
+	}
+	if director.currentState() != state || director.serverTLS.current() != certificates {
+		t.Error("Expected the current configuration to be kept")
+	}
+	if _, err := os.Stat(diff_log); !os.IsNotExist(err) || diffLogFile.path != "" {
+		t.Errorf("Expected the diff log file not to be switched. Actual: %q", diffLogFile.path)
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KalyanAkella/director/internal/metrics"
+)
+
+// Defaults for the replay queue of every secondary backend
+const (
+	DefaultQueueSize = 1000
+	DefaultWorkers   = 10
+)
+
+const (
+	DropNewest = "newest"
+	DropOldest = "oldest"
+)
+
+// replay is a request waiting to be mirrored to a secondary backend.
+type replay struct {
+	req              *http.Request
+	body             []byte
+	primary_response *capturedResponse
+	primary_latency  time.Duration
+	comparator       *comparator
+	reporter         metrics.Reporter
+}
+
+// mirror replays requests to a single secondary backend from a bounded
+// queue using a fixed number of workers. When the queue is full either
+// the new request or the oldest queued request is dropped, so mirroring
+// never blocks the primary path. Mirroring can be paused and the sample
+// rate overridden at runtime until the next configuration reload.
+type mirror struct {
+	be           *backend
+	queue        chan *replay
+	dropOldest   bool
+	lock         sync.RWMutex
+	stopped      bool
+	paused       int32
+	rateOverride atomic.Value
+}
+
+func validateDropPolicy(id, policy string) error {
+	switch policy {
+	case "", DropNewest, DropOldest:
+		return nil
+	default:
+		return proxyError(fmt.Sprintf("Invalid drop policy: %s for endpoint with ID: %s. Must be one of %s or %s", policy, id, DropNewest, DropOldest))
+	}
+}
+
+func newMirror(be *backend, process func(*backend, *replay), workers *sync.WaitGroup) *mirror {
+	m := &mirror{
+		be:         be,
+		queue:      make(chan *replay, be.queueSize),
+		dropOldest: be.dropPolicy == DropOldest,
+	}
+	workers.Add(be.workers)
+	for i := 0; i < be.workers; i++ {
+		go func() {
+			defer workers.Done()
+			for r := range m.queue {
+				process(be, r)
+			}
+		}()
+	}
+	return m
+}
+
+// offer queues the replay without blocking and reports whether a
+// request had to be dropped to respect the queue bound. Replays offered
+// once the mirror is stopped, such as during a reload, are discarded
+// without being reported as dropped.
+func (m *mirror) offer(r *replay) (dropped bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.stopped {
+		return false
+	}
+	for {
+		select {
+		case m.queue <- r:
+			return dropped
+		default:
+		}
+		if !m.dropOldest {
+			return true
+		}
+		select {
+		case <-m.queue:
+			dropped = true
+		default:
+		}
+	}
+}
+
+// stop closes the queue. Workers exit once the queued replays are processed.
+func (m *mirror) stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.stopped {
+		m.stopped = true
+		close(m.queue)
+	}
+}
+
+func (m *mirror) isPaused() bool {
+	return atomic.LoadInt32(&m.paused) == 1
+}
+
+func (m *mirror) setPaused(paused bool) {
+	if paused {
+		atomic.StoreInt32(&m.paused, 1)
+	} else {
+		atomic.StoreInt32(&m.paused, 0)
+	}
+}
+
+// sampleRate returns the rate set at runtime, if any, or the configured rate of the backend
+func (m *mirror) sampleRate() float64 {
+	if rate, ok := m.rateOverride.Load().(float64); ok {
+		return rate
+	}
+	return m.be.sampleRate
+}
+
+func (m *mirror) setSampleRate(rate float64) {
+	m.rateOverride.Store(rate)
+}
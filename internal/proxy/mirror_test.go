@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+)
+
+func newTestMirror(queueSize int, dropPolicy string) *mirror {
+	return &mirror{
+		be:         &backend{id: "B1"},
+		queue:      make(chan *replay, queueSize),
+		dropOldest: dropPolicy == DropOldest,
+	}
+}
+
+func TestMirrorDropsNewestWhenFull(t *testing.T) {
+	m := newTestMirror(1, DropNewest)
+	first, second := &replay{}, &replay{}
+	if dropped := m.offer(first); dropped {
+		t.Error("Expected first replay to be queued")
+	}
+	if dropped := m.offer(second); !dropped {
+		t.Error("Expected second replay to be dropped")
+	}
+	if queued := <-m.queue; queued != first {
+		t.Error("Expected first replay to remain queued")
+	}
+}
+
+func TestMirrorDropsOldestWhenFull(t *testing.T) {
+	m := newTestMirror(1, DropOldest)
+	first, second := &replay{}, &replay{}
+	m.offer(first)
+	if dropped := m.offer(second); !dropped {
+		t.Error("Expected a replay to be dropped")
+	}
+	if queued := <-m.queue; queued != second {
+		t.Error("Expected second replay to replace the first one")
+	}
+}
+
+func TestMirrorWorkersDrainQueueOnStop(t *testing.T) {
+	var workers sync.WaitGroup
+	var lock sync.Mutex
+	processed := 0
+	m := newMirror(&backend{id: "B1", queueSize: 10, workers: 2}, func(be *backend, r *replay) {
+		lock.Lock()
+		defer lock.Unlock()
+		processed++
+	}, &workers)
+	for i := 0; i < 5; i++ {
+		m.offer(&replay{})
+	}
+	m.stop()
+	workers.Wait()
+	if processed != 5 {
+		t.Errorf("Expected 5 processed replays. Actual: %d", processed)
+	}
+	if dropped := m.offer(&replay{}); dropped {
+		t.Error("Expected replays offered after stop not to be reported as dropped")
+	}
+	workers.Wait()
+	if processed != 5 {
+		t.Errorf("Expected replays offered after stop to be discarded. Processed: %d", processed)
+	}
+}
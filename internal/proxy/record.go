@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KalyanAkella/director/internal/metrics"
+)
+
+// Defaults for the capture file used when recording traffic
+const (
+	DefaultMaxCaptureFileSizeMB = 100
+	DefaultMaxCaptureFiles      = 5
+	RecordQueueSize             = 1000
+)
+
+// RecordingOptions configure the capture file. Values of AuthHeaders are
+// redacted in recorded requests unless KeepCredentials is set.
+type RecordingOptions struct {
+	Enabled         bool   `yaml:"Enabled"`
+	File            string `yaml:"File"`
+	MaxFileSizeMB   int    `yaml:"MaxFileSizeMB"`
+	MaxFiles        int    `yaml:"MaxFiles"`
+	KeepCredentials bool   `yaml:"KeepCredentials"`
+}
+
+// recordedExchange is a single line of a capture file.
+type recordedExchange struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Header    http.Header       `json:"header"`
+	Body      []byte            `json:"body,omitempty"`
+	Response  *recordedResponse `json:"response,omitempty"`
+}
+
+type recordedResponse struct {
+	StatusCode  int         `json:"statusCode"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body,omitempty"`
+	BodyOmitted bool        `json:"bodyOmitted,omitempty"`
+}
+
+// recorder appends exchanges as JSON lines to a capture file from a
+// single goroutine, rotating the file once it exceeds the maximum size.
+// Exchanges are dropped when the writer cannot keep up or once the
+// recorder is closed.
+type recorder struct {
+	path            string
+	maxSize         int64
+	maxFiles        int
+	keepCredentials bool
+	file            *os.File
+	size            int64
+	queue           chan *recordedExchange
+	lock            sync.RWMutex
+	closed          bool
+	done            sync.WaitGroup
+	reporter        metrics.Reporter
+}
+
+func validateRecording(options *RecordingOptions) error {
+	if options == nil || !options.Enabled {
+		return nil
+	}
+	if options.File == "" {
+		return proxyError("Capture file is missing in recording options")
+	}
+	if options.MaxFileSizeMB < 0 || options.MaxFiles < 0 {
+		return proxyError("Capture file size and count cannot be negative")
+	}
+	return nil
+}
+
+func newRecorder(options *RecordingOptions, reporter metrics.Reporter) (*recorder, error) {
+	r := &recorder{
+		path:            options.File,
+		maxSize:         int64(options.MaxFileSizeMB) << 20,
+		maxFiles:        options.MaxFiles,
+		keepCredentials: options.KeepCredentials,
+		queue:           make(chan *recordedExchange, RecordQueueSize),
+		reporter:        reporter,
+	}
+	if r.maxSize == 0 {
+		r.maxSize = DefaultMaxCaptureFileSizeMB << 20
+	}
+	if r.maxFiles == 0 {
+		r.maxFiles = DefaultMaxCaptureFiles
+	}
+	if err := r.open(); err != nil {
+		return nil, proxyError(fmt.Sprintf("Unable to open capture file %s. Error: %s", r.path, err.Error()))
+	}
+	r.done.Add(1)
+	go r.run()
+	return r, nil
+}
+
+func (r *recorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts capture files so that <file>.1 is the most recent one
+// and removes the files beyond the configured count.
+func (r *recorder) rotate() error {
+	r.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *recorder) record(req *http.Request, body []byte, res *capturedResponse) {
+	exchange := &recordedExchange{
+		Timestamp: time.Now(),
+		Method:    req.Method,
+		URL:       req.URL.RequestURI(),
+		Header:    cloneHeader(req.Header),
+		Body:      body,
+	}
+	if !r.keepCredentials {
+		for _, h := range AuthHeaders {
+			if _, present := exchange.Header[h]; present {
+				exchange.Header[h] = []string{RedactedValue}
+			}
+		}
+	}
+	if res != nil {
+		exchange.Response = &recordedResponse{StatusCode: res.statusCode, Header: res.header, Body: res.body, BodyOmitted: res.oversized}
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.closed {
+		go r.reporter.Increment("recorder.dropped.count")
+		return
+	}
+	select {
+	case r.queue <- exchange:
+	default:
+		go r.reporter.Increment("recorder.dropped.count")
+	}
+}
+
+func (r *recorder) run() {
+	defer r.done.Done()
+	writer := bufio.NewWriter(r.file)
+	for exchange := range r.queue {
+		line, err := json.Marshal(exchange)
+		if err != nil {
+			errorLog(fmt.Sprintf("Unable to encode captured request. Error: %s", err.Error()))
+			continue
+		}
+		line = append(line, '\n')
+		if r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+			writer.Flush()
+			if err := r.rotate(); err != nil {
+				errorLog(fmt.Sprintf("Unable to rotate capture file %s. Error: %s", r.path, err.Error()))
+				return
+			}
+			writer.Reset(r.file)
+		}
+		if _, err := writer.Write(line); err != nil {
+			errorLog(fmt.Sprintf("Unable to write to capture file %s. Error: %s", r.path, err.Error()))
+			continue
+		}
+		r.size += int64(len(line))
+		if len(r.queue) == 0 {
+			writer.Flush()
+		}
+	}
+	writer.Flush()
+	r.file.Close()
+}
+
+// close writes the queued exchanges and closes the capture file
+func (r *recorder) close() {
+	r.lock.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.lock.Unlock()
+	r.done.Wait()
+}
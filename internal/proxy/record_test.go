@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/KalyanAkella/director/internal/metrics"
+)
+
+func readCaptureFile(t *testing.T, path string) []recordedExchange {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var exchanges []recordedExchange
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var exchange recordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			t.Fatal(err)
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	return exchanges
+}
+
+func TestRecorderWritesAndRotatesCaptureFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.jsonl")
+	r, err := newRecorder(&RecordingOptions{Enabled: true, File: path, MaxFiles: 2}, metrics.NewNoopReporter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.maxSize = 300
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "http://localhost/items?id=1", nil)
+		req.Header.Set("X-User-Id", "42")
+		r.record(req, []byte(`{"name":"item"}`), &capturedResponse{statusCode: 201, header: http.Header{}, body: []byte("created")})
+	}
+	r.close()
+
+	current := readCaptureFile(t, path)
+	rotated := append(readCaptureFile(t, path+".1"), readCaptureFile(t, path+".2")...)
+	if len(current) != 1 || len(rotated) != 2 {
+		t.Fatalf("Expected exchanges across rotated files. Actual: %d current, %d rotated", len(current), len(rotated))
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 2 rotated capture files")
+	}
+	exchange := current[len(current)-1]
+	if exchange.Method != "POST" || exchange.URL != "/items?id=1" || string(exchange.Body) != `{"name":"item"}` {
+		t.Errorf("Unexpected exchange %+v", exchange)
+	}
+	if exchange.Header.Get("X-User-Id") != "42" || exchange.Response == nil || exchange.Response.StatusCode != 201 {
+		t.Errorf("Unexpected exchange headers or response %+v", exchange)
+	}
+}
+
+func TestRecorderRedactsCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, keep := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("capture-%t.jsonl", keep))
+		r, err := newRecorder(&RecordingOptions{Enabled: true, File: path, KeepCredentials: keep}, metrics.NewNoopReporter())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-User-Id", "42")
+		r.record(req, nil, nil)
+		r.close()
+		if info, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != 0600 {
+			t.Errorf("Expected the capture file to be readable by its owner only. Actual: %v", info.Mode().Perm())
+		}
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Expected the request headers to be left untouched. Actual: %v", req.Header)
+		}
+		exchanges := readCaptureFile(t, path)
+		if len(exchanges) != 1 {
+			t.Fatalf("Expected one recorded exchange. Actual: %d", len(exchanges))
+		}
+		header := exchanges[0].Header
+		if keep && (header.Get("Authorization") != "Bearer secret" || header.Get("Cookie") != "session=secret") {
+			t.Errorf("Expected credentials to be kept. Actual: %v", header)
+		}
+		if !keep && (header.Get("Authorization") != RedactedValue || header.Get("Cookie") != RedactedValue) {
+			t.Errorf("Expected credentials to be redacted. Actual: %v", header)
+		}
+		if header.Get("X-User-Id") != "42" {
+			t.Errorf("Expected other headers to be recorded. Actual: %v", header)
+		}
+	}
+}
+
+func TestRecorderDropsExchangesOnceClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.jsonl")
+	r, err := newRecorder(&RecordingOptions{Enabled: true, File: path}, metrics.NewNoopReporter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.close()
+	r.close()
+	r.record(httptest.NewRequest("GET", "http://localhost/", nil), nil, nil)
+	if exchanges := readCaptureFile(t, path); len(exchanges) != 0 {
+		t.Errorf("Expected no exchanges to be recorded after close. Actual: %d", len(exchanges))
+	}
+}
+
+func TestRecordingWithoutComparison(t *testing.T) {
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "primary")
+	}))
+	defer primary.Close()
+	var replayed int32
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&replayed, 1)
+		fmt.Fprint(w, "secondary")
+	}))
+	defer secondary.Close()
+	path := filepath.Join(dir, "capture.jsonl")
+	director, err := NewDirector(&ProxyConfig{
+		Backends:  map[string]*BackendConfig{PrimaryTag: {URL: primary.URL}, "B1": {URL: secondary.URL}},
+		Options:   &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: PrimaryTag, LogLevel: ERROR},
+		Recording: &RecordingOptions{Enabled: true, File: path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	director.handler(rw, httptest.NewRequest("GET", "http://localhost/items", nil))
+	if err := director.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Body.String() != "primary" {
+		t.Errorf("Expected the primary response. Actual: %s", rw.Body.String())
+	}
+	if count := atomic.LoadInt32(&replayed); count != 1 {
+		t.Errorf("Expected the request to be mirrored once. Actual: %d", count)
+	}
+	if exchanges := readCaptureFile(t, path); len(exchanges) != 1 || exchanges[0].Response == nil || string(exchanges[0].Response.Body) != "primary" {
+		t.Errorf("Expected the exchange to be recorded with the primary response. Actual: %+v", exchanges)
+	}
+}
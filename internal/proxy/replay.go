@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/KalyanAkella/director/internal/metrics"
+)
+
+// Pacing modes for replaying a capture file
+const (
+	ReplayOriginalTiming   = "original"
+	ReplayFixedRate        = "rps"
+	ReplayAsFastAsPossible = "fast"
+)
+
+// Maximum size of a single line in a capture file
+const MaxCaptureLineBytes = 64 << 20
+
+type ReplayOptions struct {
+	CaptureFile string
+	Mode        string
+	RPS         float64
+	Concurrency int
+}
+
+// replayStats accumulates the results of replayed requests for one backend.
+type replayStats struct {
+	role       string
+	lock       sync.Mutex
+	latencies  []time.Duration
+	errors     int
+	matches    int
+	mismatches int
+}
+
+func (s *replayStats) add(latency time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.errors++
+	} else {
+		s.latencies = append(s.latencies, latency)
+	}
+}
+
+func (s *replayStats) compared(match bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if match {
+		s.matches++
+	} else {
+		s.mismatches++
+	}
+}
+
+func validateReplay(options *ReplayOptions) error {
+	if options.CaptureFile == "" {
+		return proxyError("Capture file to replay is missing")
+	}
+	switch options.Mode {
+	case ReplayOriginalTiming, ReplayAsFastAsPossible:
+	case ReplayFixedRate:
+		if options.RPS <= 0 {
+			return proxyError("Requests per second must be positive when replaying at a fixed rate")
+		}
+	default:
+		return proxyError(fmt.Sprintf("Invalid replay mode: %s. Must be one of %s, %s or %s", options.Mode, ReplayOriginalTiming, ReplayFixedRate, ReplayAsFastAsPossible))
+	}
+	if options.Concurrency <= 0 {
+		return proxyError("Replay concurrency must be positive")
+	}
+	return nil
+}
+
+type replayer struct {
+	routes     []*route
+	comparator *comparator
+	reporter   metrics.Reporter
+	stats      map[string]*replayStats
+}
+
+// Replay sends every request of a capture file to the primary and the
+// enabled secondary backends of the given configuration, compares the
+// secondary responses with the primary one and writes a summary of the
+// latencies and comparison results per backend to out.
+func Replay(proxyConfig *ProxyConfig, options *ReplayOptions, out io.Writer) error {
+	if err := validate(proxyConfig); err != nil {
+		return err
+	}
+	if err := validateReplay(options); err != nil {
+		return err
+	}
+	if err := configureDiffLog(proxyConfig); err != nil {
+		return err
+	}
+	configureLogger(proxyConfig.Options)
+	file, err := os.Open(options.CaptureFile)
+	if err != nil {
+		return proxyError(fmt.Sprintf("Unable to open capture file %s. Error: %s", options.CaptureFile, err.Error()))
+	}
+	defer file.Close()
+
+	r := &replayer{
+		routes:     proxyConfig.routes,
+		comparator: proxyConfig.comparator,
+		reporter:   metrics.NewNoopReporter(),
+		stats:      make(map[string]*replayStats),
+	}
+	if r.comparator == nil {
+		r.comparator, _ = newComparator(&ComparisonOptions{Enabled: true})
+		r.comparator.diffLog = log.New(ioutil.Discard, "", 0)
+	}
+	for _, rt := range r.routes {
+		r.stats[rt.primary.id] = &replayStats{role: "primary"}
+		for _, secondary := range rt.secondaries {
+			r.stats[secondary.id] = &replayStats{role: "secondary"}
+		}
+	}
+
+	slots := make(chan struct{}, options.Concurrency)
+	var pending sync.WaitGroup
+	var first_recorded time.Time
+	started := time.Now()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), MaxCaptureLineBytes)
+	for count := 0; scanner.Scan(); count++ {
+		var exchange recordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return proxyError(fmt.Sprintf("Invalid entry in capture file %s. Error: %s", options.CaptureFile, err.Error()))
+		}
+		switch options.Mode {
+		case ReplayOriginalTiming:
+			if first_recorded.IsZero() {
+				first_recorded = exchange.Timestamp
+			}
+			time.Sleep(time.Until(started.Add(exchange.Timestamp.Sub(first_recorded))))
+		case ReplayFixedRate:
+			time.Sleep(time.Until(started.Add(time.Duration(float64(count) / options.RPS * float64(time.Second)))))
+		}
+		slots <- struct{}{}
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			defer func() { <-slots }()
+			r.replayExchange(&exchange)
+		}()
+	}
+	pending.Wait()
+	if err := scanner.Err(); err != nil {
+		return proxyError(fmt.Sprintf("Unable to read capture file %s. Error: %s", options.CaptureFile, err.Error()))
+	}
+	r.writeSummary(out)
+	return nil
+}
+
+func (r *replayer) send(req *http.Request, body []byte, be *backend, role string) (*capturedResponse, error) {
+	start := time.Now()
+	res, err := requestToBackend(newRequest(context.Background(), req, body, be), be, r.reporter, role)
+	var captured *capturedResponse
+	if err == nil {
+		captured, err = captureResponse(res)
+	}
+	r.stats[be.id].add(time.Since(start), err)
+	return captured, err
+}
+
+func (r *replayer) replayExchange(exchange *recordedExchange) {
+	req, err := http.NewRequest(exchange.Method, exchange.URL, bytes.NewReader(exchange.Body))
+	if err != nil {
+		errorLog(fmt.Sprintf("Unable to replay %s %s. Error: %s", exchange.Method, exchange.URL, err.Error()))
+		return
+	}
+	req.Header = exchange.Header
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	rt := matchRoute(r.routes, req)
+	if rt == nil {
+		infoLog(fmt.Sprintf("No route to replay %s %s", exchange.Method, exchange.URL))
+		return
+	}
+	primary_response, primary_err := r.send(req, exchange.Body, rt.primary, "primary")
+	var secondaries sync.WaitGroup
+	for _, secondary := range rt.secondaries {
+		secondary := secondary
+		if !secondary.filter.allows(req) {
+			continue
+		}
+		secondaries.Add(1)
+		go func() {
+			defer secondaries.Done()
+			if secondary_response, err := r.send(req, exchange.Body, secondary, "secondary"); err == nil && primary_err == nil && !primary_response.oversized && !secondary_response.oversized {
+				diffs := r.comparator.compare(primary_response, secondary_response)
+				r.stats[secondary.id].compared(len(diffs) == 0)
+				if len(diffs) > 0 {
+					r.comparator.logMismatch(req, secondary, diffs)
+				}
+			}
+		}()
+	}
+	secondaries.Wait()
+}
+
+func (r *replayer) writeSummary(out io.Writer) {
+	ids := make([]string, 0, len(r.stats))
+	for id := range r.stats {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if r.stats[ids[i]].role != r.stats[ids[j]].role {
+			return r.stats[ids[i]].role == "primary"
+		}
+		return ids[i] < ids[j]
+	})
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tROLE\tREQUESTS\tERRORS\tP50\tP90\tP99\tMATCHES\tMISMATCHES")
+	for _, id := range ids {
+		s := r.stats[id]
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		matches, mismatches := "-", "-"
+		if s.role == "secondary" {
+			matches, mismatches = fmt.Sprint(s.matches), fmt.Sprint(s.mismatches)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%v\t%v\t%v\t%s\t%s\n", id, s.role, len(s.latencies)+s.errors, s.errors,
+			percentile(s.latencies, 50), percentile(s.latencies, 90), percentile(s.latencies, 99), matches, mismatches)
+	}
+	w.Flush()
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeCaptureFile(t *testing.T, dir string, exchanges ...recordedExchange) string {
+	var buf bytes.Buffer
+	for _, exchange := range exchanges {
+		if line, err := json.Marshal(exchange); err != nil {
+			t.Fatal(err)
+		} else {
+			buf.Write(append(line, '\n'))
+		}
+	}
+	path := filepath.Join(dir, "capture.jsonl")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplayCaptureFile(t *testing.T) {
+	primary_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer primary_server.Close()
+	secondary_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/changed" {
+			fmt.Fprint(w, "something else")
+		} else {
+			fmt.Fprint(w, r.URL.Path)
+		}
+	}))
+	defer secondary_server.Close()
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	capture_file := writeCaptureFile(t, dir,
+		recordedExchange{Timestamp: now, Method: "GET", URL: "/same"},
+		recordedExchange{Timestamp: now.Add(10 * time.Millisecond), Method: "POST", URL: "/changed", Body: []byte("a=1")},
+	)
+
+	var out bytes.Buffer
+	err = Replay(&ProxyConfig{
+		Backends: map[string]*BackendConfig{"B1": {URL: primary_server.URL}, "B2": {URL: secondary_server.URL}},
+		Options:  &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: "B1", LogLevel: ERROR},
+	}, &ReplayOptions{CaptureFile: capture_file, Mode: ReplayOriginalTiming, Concurrency: 2}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a header and 2 backends in summary:\n%s", out.String())
+	}
+	if fields := strings.Fields(lines[1]); fields[0] != "B1" || fields[2] != "2" || fields[3] != "0" {
+		t.Errorf("Unexpected primary summary: %s", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); fields[0] != "B2" || fields[2] != "2" || fields[7] != "1" || fields[8] != "1" {
+		t.Errorf("Unexpected secondary summary: %s", lines[2])
+	}
+}
+
+func TestReplayUsesConfiguredLogFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "director")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	capture_file := writeCaptureFile(t, dir, recordedExchange{Timestamp: time.Now(), Method: "GET", URL: "/"})
+	log_file := filepath.Join(dir, "director.log")
+	defer proxyLogFile.setPath("")
+	err = Replay(&ProxyConfig{
+		Backends: map[string]*BackendConfig{"B1": {URL: server.URL}},
+		Options:  &ProxyOptions{Port: DirectorServerPort, PrimaryEndpoint: "B1", LogLevel: ERROR, LogFile: log_file},
+	}, &ReplayOptions{CaptureFile: capture_file, Mode: ReplayOriginalTiming, Concurrency: 1}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyLogFile.path != log_file {
+		t.Errorf("Expected replay to log to %s. Actual: %q", log_file, proxyLogFile.path)
+	}
+	if _, err := os.Stat(log_file); err != nil {
+		t.Errorf("Expected the log file to be created. Error: %v", err)
+	}
+}
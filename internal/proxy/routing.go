@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Route label of the metrics when no routes are configured
+const DefaultRouteLabel = "default"
+
+// RouteConfig sends the requests matching all of its non empty conditions
+// to its own primary and mirrors them to its own secondaries.
+type RouteConfig struct {
+	Name        string   `yaml:"Name"`
+	PathPrefix  string   `yaml:"PathPrefix"`
+	PathRegex   string   `yaml:"PathRegex"`
+	Methods     []string `yaml:"Methods"`
+	Primary     string   `yaml:"Primary"`
+	Fallbacks   []string `yaml:"Fallbacks"`
+	Secondaries []string `yaml:"Secondaries"`
+}
+
+type route struct {
+	name        string
+	pathPrefix  string
+	pathRegex   *regexp.Regexp
+	methods     map[string]bool
+	primary     *backend
+	fallbacks   []*backend
+	secondaries []*backend
+}
+
+// primaryIDs returns the IDs of the backends serving responses, including fallbacks
+func primaryIDs(config *ProxyConfig) map[string]bool {
+	ids := make(map[string]bool)
+	if len(config.Routes) == 0 {
+		ids[config.Options.PrimaryEndpoint] = true
+		for _, id := range config.Options.FallbackEndpoints {
+			ids[id] = true
+		}
+	}
+	for _, r := range config.Routes {
+		if r == nil {
+			continue
+		}
+		ids[r.Primary] = true
+		for _, id := range r.Fallbacks {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func resolveFallbacks(config *ProxyConfig, name, primary string, ids []string) ([]*backend, error) {
+	fallbacks := make([]*backend, len(ids))
+	for i, id := range ids {
+		if _, present := config.Backends[id]; !present {
+			return nil, proxyError(fmt.Sprintf("Fallback backend [%s] of route [%s] missing from the given set of backends", id, name))
+		}
+		if id == primary {
+			return nil, proxyError(fmt.Sprintf("Backend [%s] of route [%s] cannot be a fallback of itself", id, name))
+		}
+		fallbacks[i] = config.backends[id]
+	}
+	return fallbacks, nil
+}
+
+// newRoutes builds the routing table from the validated backends. Without
+// any configured routes, every request goes to the primary endpoint and
+// is mirrored to all the other enabled backends.
+func newRoutes(config *ProxyConfig) ([]*route, error) {
+	primaries := primaryIDs(config)
+	if len(config.Routes) == 0 {
+		r := &route{primary: config.backends[config.Options.PrimaryEndpoint]}
+		if fallbacks, err := resolveFallbacks(config, "default", config.Options.PrimaryEndpoint, config.Options.FallbackEndpoints); err != nil {
+			return nil, err
+		} else {
+			r.fallbacks = fallbacks
+		}
+		for id, be := range config.backends {
+			if !primaries[id] {
+				r.secondaries = append(r.secondaries, be)
+			}
+		}
+		sort.Slice(r.secondaries, func(i, j int) bool { return r.secondaries[i].id < r.secondaries[j].id })
+		return []*route{r}, nil
+	}
+	names := make(map[string]bool, len(config.Routes))
+	routes := make([]*route, len(config.Routes))
+	for i, rc := range config.Routes {
+		if rc == nil || rc.Name == "" {
+			return nil, proxyError(fmt.Sprintf("Route at position %d does not have a name", i+1))
+		}
+		if names[rc.Name] {
+			return nil, proxyError(fmt.Sprintf("Duplicate route with name: %s", rc.Name))
+		}
+		names[rc.Name] = true
+		if _, present := config.Backends[rc.Primary]; !present {
+			return nil, proxyError(fmt.Sprintf("Primary backend [%s] of route [%s] missing from the given set of backends", rc.Primary, rc.Name))
+		}
+		r := &route{name: rc.Name, pathPrefix: rc.PathPrefix, methods: methodSet(rc.Methods), primary: config.backends[rc.Primary]}
+		if fallbacks, err := resolveFallbacks(config, rc.Name, rc.Primary, rc.Fallbacks); err != nil {
+			return nil, err
+		} else {
+			r.fallbacks = fallbacks
+		}
+		if rc.PathRegex != "" {
+			if pathRegex, err := regexp.Compile(rc.PathRegex); err != nil {
+				return nil, proxyError(fmt.Sprintf("Invalid path pattern: %s for route [%s]. Error: %s", rc.PathRegex, rc.Name, err.Error()))
+			} else {
+				r.pathRegex = pathRegex
+			}
+		}
+		for _, id := range rc.Secondaries {
+			if _, present := config.Backends[id]; !present {
+				return nil, proxyError(fmt.Sprintf("Secondary backend [%s] of route [%s] missing from the given set of backends", id, rc.Name))
+			}
+			if primaries[id] {
+				return nil, proxyError(fmt.Sprintf("Backend [%s] of route [%s] cannot be both a primary and a secondary", id, rc.Name))
+			}
+			if secondary, enabled := config.backends[id]; enabled {
+				r.secondaries = append(r.secondaries, secondary)
+			}
+		}
+		routes[i] = r
+	}
+	return routes, nil
+}
+
+func (r *route) matches(req *http.Request) bool {
+	if len(r.methods) > 0 && !r.methods[req.Method] {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, r.pathPrefix) {
+		return false
+	}
+	return r.pathRegex == nil || r.pathRegex.MatchString(req.URL.Path)
+}
+
+// label is the name of the route, or default for the route used when no
+// routes are configured.
+func (r *route) label() string {
+	if r.name != "" {
+		return r.name
+	}
+	return DefaultRouteLabel
+}
+
+// matchRoute returns the first route matching the request, or nil
+func matchRoute(routes []*route, req *http.Request) *route {
+	for _, r := range routes {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const routesYAML = `
+Options:
+  Port: 30303
+Backends:
+  orders-v1: http://127.0.0.1:50505
+  orders-v2: http://127.0.0.1:51515
+  users-v1: http://127.0.0.1:52525
+  users-v2:
+    URL: http://127.0.0.1:53535
+    Enabled: false
+Routes:
+  - Name: order-writes
+    PathPrefix: /orders
+    Methods: [POST, PUT]
+    Primary: orders-v1
+  - Name: orders
+    PathPrefix: /orders
+    Primary: orders-v1
+    Secondaries: [orders-v2]
+  - Name: users
+    PathRegex: ^/users/[0-9]+$
+    Primary: users-v1
+    Secondaries: [users-v2]
+`
+
+func TestRoutingToMultiplePrimaries(t *testing.T) {
+	var config ProxyConfig
+	if err := yaml.Unmarshal([]byte(routesYAML), &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(&config); err != nil {
+		t.Fatal(err)
+	}
+	for target, expected := range map[string]string{
+		"POST /orders/1":  "order-writes",
+		"GET /orders/1":   "orders",
+		"GET /users/42":   "users",
+		"GET /users/me":   "",
+		"GET /catalog/42": "",
+	} {
+		parts := strings.SplitN(target, " ", 2)
+		name := ""
+		if rt := matchRoute(config.routes, httptest.NewRequest(parts[0], "http://localhost"+parts[1], nil)); rt != nil {
+			name = rt.name
+		}
+		if name != expected {
+			t.Errorf("Expected %s to match route %q. Actual: %q", target, expected, name)
+		}
+	}
+	orders, users := config.routes[1], config.routes[2]
+	if orders.primary.id != "orders-v1" || len(orders.secondaries) != 1 || orders.secondaries[0].id != "orders-v2" {
+		t.Errorf("Unexpected backends for route orders %+v", orders)
+	}
+	if users.primary.id != "users-v1" || len(users.secondaries) != 0 {
+		t.Errorf("Expected disabled secondary to be left out of route users %+v", users)
+	}
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	config := func(routes ...*RouteConfig) *ProxyConfig {
+		return &ProxyConfig{
+			Options: &ProxyOptions{Port: 1},
+			Backends: map[string]*BackendConfig{
+				"B1": {URL: "http://localhost:1"},
+				"B2": {URL: "http://localhost:2"},
+			},
+			Routes: routes,
+		}
+	}
+	invalid := map[string]*ProxyConfig{
+		"unnamed route":          config(&RouteConfig{Primary: "B1"}),
+		"duplicate route":        config(&RouteConfig{Name: "a", Primary: "B1"}, &RouteConfig{Name: "a", Primary: "B1"}),
+		"unknown primary":        config(&RouteConfig{Name: "a", Primary: "B3"}),
+		"unknown secondary":      config(&RouteConfig{Name: "a", Primary: "B1", Secondaries: []string{"B3"}}),
+		"primary as secondary":   config(&RouteConfig{Name: "a", Primary: "B1"}, &RouteConfig{Name: "b", Primary: "B2", Secondaries: []string{"B1"}}),
+		"invalid path pattern":   config(&RouteConfig{Name: "a", Primary: "B1", PathRegex: "("}),
+		"routes and primary set": config(&RouteConfig{Name: "a", Primary: "B1"}),
+	}
+	invalid["routes and primary set"].Options.PrimaryEndpoint = "B1"
+	for reason, c := range invalid {
+		if err := validate(c); err == nil {
+			t.Errorf("Expected validation error for %s", reason)
+		}
+	}
+}
+
+func TestMetricLabelsAreBounded(t *testing.T) {
+	config := &ProxyConfig{
+		Options:  &ProxyOptions{Port: 1, PrimaryEndpoint: "B1"},
+		Backends: map[string]*BackendConfig{"B1": {URL: "http://localhost:1"}},
+	}
+	if err := validate(config); err != nil {
+		t.Fatal(err)
+	}
+	if label := config.routes[0].label(); label != DefaultRouteLabel {
+		t.Errorf("Expected the %s route label without routes. Actual: %s", DefaultRouteLabel, label)
+	}
+	for method, expected := range map[string]string{"GET": "GET", "DELETE": "DELETE", "get": "other", "RANDOM": "other"} {
+		if label := methodLabel(method); label != expected {
+			t.Errorf("Expected method label %s for %s. Actual: %s", expected, method, label)
+		}
+	}
+}
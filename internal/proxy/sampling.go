@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+)
+
+// Sample rates are percentages and deterministic sampling works on buckets of 0.01%
+const (
+	FullSampleRate     = 100.0
+	NumSamplingBuckets = 10000
+)
+
+// SamplingOptions configure deterministic sampling. Rates is deprecated in
+// favour of the SampleRate of every backend.
+type SamplingOptions struct {
+	Rates     map[string]float64 `yaml:"Rates"`
+	KeyHeader string             `yaml:"KeyHeader"`
+	KeyParam  string             `yaml:"KeyParam"`
+}
+
+// sampler decides whether a request is mirrored to a secondary. When a
+// sampling key is present on the request the decision is deterministic,
+// so the same key is always either mirrored or not.
+type sampler struct {
+	keyHeader string
+	keyParam  string
+}
+
+func validateSampling(config *ProxyConfig, primaries map[string]bool) error {
+	for id, v := range config.Backends {
+		if v == nil || v.SampleRate == nil {
+			continue
+		}
+		if primaries[id] {
+			return proxyError(fmt.Sprintf("Sample rate cannot be applied to the primary backend with ID: %s", id))
+		}
+		if rate := *v.SampleRate; rate < 0 || rate > FullSampleRate {
+			return proxyError(fmt.Sprintf("Sample rate %v for backend with ID: %s must be between 0 and 100", rate, id))
+		}
+	}
+	if config.Sampling == nil || len(config.Sampling.Rates) == 0 {
+		return nil
+	}
+	errorLog("Rates in the sampling options are deprecated. Set SampleRate on the backends instead")
+	for id, rate := range config.Sampling.Rates {
+		if primaries[id] {
+			return proxyError(fmt.Sprintf("Sample rate cannot be applied to the primary backend with ID: %s", id))
+		}
+		if v, present := config.Backends[id]; !present {
+			return proxyError(fmt.Sprintf("Sample rate given for unknown backend with ID: %s", id))
+		} else if v != nil && v.SampleRate != nil {
+			return proxyError(fmt.Sprintf("Sample rate for backend with ID: %s is set both on the backend and in the sampling options", id))
+		}
+		if rate < 0 || rate > FullSampleRate {
+			return proxyError(fmt.Sprintf("Sample rate %v for backend with ID: %s must be between 0 and 100", rate, id))
+		}
+	}
+	return nil
+}
+
+func newSampler(options *SamplingOptions) *sampler {
+	if options == nil {
+		return &sampler{}
+	}
+	return &sampler{keyHeader: options.KeyHeader, keyParam: options.KeyParam}
+}
+
+// sampleRate returns the rate configured on the backend, or in the
+// deprecated Rates of the sampling options, and mirrors every request
+// otherwise. Validation ensures a rate is not set in both places.
+func sampleRate(config *ProxyConfig, id string) float64 {
+	if v := config.Backends[id]; v != nil && v.SampleRate != nil {
+		return *v.SampleRate
+	}
+	if config.Sampling != nil {
+		if rate, present := config.Sampling.Rates[id]; present {
+			return rate
+		}
+	}
+	return FullSampleRate
+}
+
+func (s *sampler) samplingKey(req *http.Request) string {
+	if s.keyHeader != "" {
+		if key := req.Header.Get(s.keyHeader); key != "" {
+			return key
+		}
+	}
+	if s.keyParam != "" {
+		return req.URL.Query().Get(s.keyParam)
+	}
+	return ""
+}
+
+func (s *sampler) sample(req *http.Request, rate float64) bool {
+	switch {
+	case rate >= FullSampleRate:
+		return true
+	case rate <= 0:
+		return false
+	}
+	if key := s.samplingKey(req); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return float64(h.Sum32()%NumSamplingBuckets) < rate*NumSamplingBuckets/FullSampleRate
+	}
+	return rand.Float64()*FullSampleRate < rate
+}
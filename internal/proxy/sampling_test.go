@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSampleRateBounds(t *testing.T) {
+	s := newSampler(nil)
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	if !s.sample(req, FullSampleRate) {
+		t.Error("Expected request to be sampled at 100%")
+	}
+	if s.sample(req, 0) {
+		t.Error("Expected request not to be sampled at 0%")
+	}
+}
+
+func TestDeterministicSampling(t *testing.T) {
+	s := newSampler(&SamplingOptions{KeyHeader: "X-User-Id", KeyParam: "user"})
+	rate := 50.0
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		by_header := httptest.NewRequest("GET", "http://localhost/", nil)
+		by_header.Header.Set("X-User-Id", user)
+		by_param := httptest.NewRequest("GET", "http://localhost/?user="+user, nil)
+		decision := s.sample(by_header, rate)
+		if decision != s.sample(by_header, rate) || decision != s.sample(by_param, rate) {
+			t.Fatalf("Expected a stable sampling decision for %s", user)
+		}
+		if decision {
+			sampled++
+		}
+	}
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("Expected roughly half of the keys to be sampled. Actual: %d of 1000", sampled)
+	}
+}
+
+func TestValidateSamplingRates(t *testing.T) {
+	config := func(rate float64) *ProxyConfig {
+		return &ProxyConfig{
+			Options:  &ProxyOptions{Port: 1, PrimaryEndpoint: "B1"},
+			Backends: map[string]*BackendConfig{"B1": {URL: "http://localhost:1"}, "B2": {URL: "http://localhost:2", SampleRate: &rate}},
+		}
+	}
+	for _, rate := range []float64{101, -1} {
+		if err := validate(config(rate)); err == nil {
+			t.Errorf("Expected validation error for sample rate %v", rate)
+		}
+	}
+	primary := config(25)
+	primary.Backends["B1"].SampleRate = primary.Backends["B2"].SampleRate
+	if err := validate(primary); err == nil {
+		t.Error("Expected validation error for a sample rate on the primary")
+	}
+	valid := config(25)
+	if err := validate(valid); err != nil {
+		t.Fatal(err)
+	}
+	if valid.routes[0].secondaries[0].sampleRate != 25 {
+		t.Errorf("Expected sample rate 25. Actual: %v", valid.routes[0].secondaries[0].sampleRate)
+	}
+}
+
+func TestDeprecatedSamplingRates(t *testing.T) {
+	config := func(rates map[string]float64) *ProxyConfig {
+		return &ProxyConfig{
+			Options:  &ProxyOptions{Port: 1, PrimaryEndpoint: "B1"},
+			Backends: map[string]*BackendConfig{"B1": {URL: "http://localhost:1"}, "B2": {URL: "http://localhost:2"}},
+			Sampling: &SamplingOptions{Rates: rates},
+		}
+	}
+	for _, rates := range []map[string]float64{{"B1": 10}, {"B3": 10}, {"B2": 101}, {"B2": -1}} {
+		if err := validate(config(rates)); err == nil {
+			t.Errorf("Expected validation error for sample rates %v", rates)
+		}
+	}
+	both := config(map[string]float64{"B2": 25})
+	rate := 50.0
+	both.Backends["B2"].SampleRate = &rate
+	if err := validate(both); err == nil {
+		t.Error("Expected validation error for a sample rate set in both places")
+	}
+	valid := config(map[string]float64{"B2": 25})
+	if err := validate(valid); err != nil {
+		t.Fatal(err)
+	}
+	if valid.routes[0].secondaries[0].sampleRate != 25 {
+		t.Errorf("Expected sample rate 25. Actual: %v", valid.routes[0].secondaries[0].sampleRate)
+	}
+}